@@ -0,0 +1,177 @@
+package gows
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type adminConnectionInfo struct {
+	Id            string    `json:"id"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	RemoteIP      string    `json:"remoteIP"`
+	Principal     string    `json:"principal,omitempty"`
+	UserAgent     string    `json:"userAgent"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	// Round-trip of the server's last ping, which is only sent once the connection has been idle for the heartbeat interval, 0 until then
+	LatencyMs float64 `json:"latencyMs"`
+
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	BytesReceived    uint64 `json:"bytesReceived"`
+	BytesSent        uint64 `json:"bytesSent"`
+
+	Data map[string]interface{} `json:"data"`
+}
+
+func newAdminConnectionInfo(connection *Connection) adminConnectionInfo {
+	stats := connection.GetStats()
+
+	info := adminConnectionInfo{
+		Id:            connection.GetId(),
+		RemoteIP:      connection.GetRemoteIP(),
+		Principal:     connection.GetPrincipal(),
+		ConnectedAt:   stats.ConnectedAt,
+		LastHeartbeat: stats.LastHeartbeat,
+		LatencyMs:     float64(stats.Latency) / float64(time.Millisecond),
+
+		MessagesReceived: stats.MessagesReceived,
+		MessagesSent:     stats.MessagesSent,
+		BytesReceived:    stats.BytesReceived,
+		BytesSent:        stats.BytesSent,
+
+		Data: connection.Data.Snapshot(),
+	}
+
+	if connection.Request != nil {
+		info.RemoteAddr = connection.Request.RemoteAddr
+		info.UserAgent = connection.Request.UserAgent()
+	}
+
+	return info
+}
+
+type adminHandler struct {
+	server *Server
+	mux    *http.ServeMux
+}
+
+func (handler *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.mux.ServeHTTP(w, r)
+}
+
+func (handler *adminHandler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	// Encoded first, so that a failure can still be reported with a 500
+	var buffer bytes.Buffer
+	err := jsoniter.NewEncoder(&buffer).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buffer.Bytes())
+}
+
+func (handler *adminHandler) writeError(w http.ResponseWriter, status int, message string) {
+	handler.writeJSON(w, status, map[string]interface{}{"error": message})
+}
+
+func (handler *adminHandler) getConnection(w http.ResponseWriter, r *http.Request) (connection *Connection, found bool) {
+	connection, found = handler.server.Connections.Get(r.PathValue("id"))
+
+	if !found {
+		handler.writeError(w, http.StatusNotFound, "connection not found")
+		return nil, false
+	}
+
+	return connection, true
+}
+
+func (handler *adminHandler) listConnections(w http.ResponseWriter, r *http.Request) {
+	connections := handler.server.Connections.snapshot()
+
+	infos := make([]adminConnectionInfo, 0, len(connections))
+	for _, connection := range connections {
+		infos = append(infos, newAdminConnectionInfo(connection))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+
+	handler.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":       len(infos),
+		"connections": infos,
+	})
+}
+
+func (handler *adminHandler) describeConnection(w http.ResponseWriter, r *http.Request) {
+	connection, found := handler.getConnection(w, r)
+	if !found {
+		return
+	}
+
+	handler.writeJSON(w, http.StatusOK, newAdminConnectionInfo(connection))
+}
+
+func (handler *adminHandler) closeConnection(w http.ResponseWriter, r *http.Request) {
+	connection, found := handler.getConnection(w, r)
+	if !found {
+		return
+	}
+
+	connection.Close()
+
+	handler.writeJSON(w, http.StatusOK, map[string]interface{}{"closed": connection.GetId()})
+}
+
+func (handler *adminHandler) broadcast(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		handler.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !jsoniter.Valid(body) {
+		handler.writeError(w, http.StatusBadRequest, "body must be valid JSON")
+		return
+	}
+
+	failCount, err := handler.server.Broadcast(jsoniter.RawMessage(body))
+	if err != nil {
+		handler.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	handler.writeJSON(w, http.StatusOK, map[string]interface{}{"failCount": failCount})
+}
+
+// Returns an http.Handler exposing the server's connections for operators, it is meant to be mounted under a prefix of your choice:
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", server.AdminHandler()))
+//
+// Routes:
+//
+//	GET  /connections            lists all connections
+//	GET  /connections/{id}       describes a single connection
+//	POST /connections/{id}/close force-closes a connection
+//	POST /broadcast              broadcasts the JSON request body to all connections
+//
+// WARNING: The handler performs no authentication, make sure to wrap it with your own before exposing it
+func (server *Server) AdminHandler() http.Handler {
+	handler := &adminHandler{
+		server: server,
+		mux:    http.NewServeMux(),
+	}
+
+	handler.mux.HandleFunc("GET /connections", handler.listConnections)
+	handler.mux.HandleFunc("GET /connections/{id}", handler.describeConnection)
+	handler.mux.HandleFunc("POST /connections/{id}/close", handler.closeConnection)
+	handler.mux.HandleFunc("POST /broadcast", handler.broadcast)
+
+	return handler
+}
@@ -1,25 +1,80 @@
 package gows
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/GTedZ/gows/parser"
 	"github.com/GTedZ/gows/websockets"
 	ws "github.com/gorilla/websocket"
 )
 
+// permessage-deflate settings, shared by 'Client_params' and 'Server_Params'
+type CompressionOptions = websockets.CompressionOptions
+
+// Describes how a connection ended, see 'Client.OnDisconnect', 'Client.OnClose' and 'Connection.OnClose'
+type CloseInfo = websockets.CloseInfo
+
+// How long 'CloseWithCode()' waits for the peer to answer the close frame
+const CLOSE_HANDSHAKE_TIMEOUT_SEC = websockets.CLOSE_HANDSHAKE_TIMEOUT_SEC
+
+// Default size in bytes above which inbound messages are delivered through 'OnMessageStream' (when set)
+const STREAM_THRESHOLD_BYTES = websockets.STREAM_THRESHOLD_BYTES
+
+type State = websockets.State
+
+const (
+	State_Connecting   = websockets.State_Connecting
+	State_Open         = websockets.State_Open
+	State_Reconnecting = websockets.State_Reconnecting
+	State_Closing      = websockets.State_Closing
+	State_Closed       = websockets.State_Closed
+)
+
+// Kept for backwards compatibility, every field has an equivalent 'With...' option
+//
+// Zero-valued fields are ignored, so it can be mixed with other options
 type Client_params struct {
-	query   map[string]string
-	headers http.Header
+	// Query parameters added to the URL on every (re)connection
+	Query map[string]string
+	// HTTP headers sent with every (re)connection handshake
+	Headers http.Header
 	// Default is "id"
 	PrivateRequestPropertyName string
+
+	// Maximum size in bytes of an inbound message, 0 means unlimited
+	//
+	// A bigger message closes the connection with 1009 (Message Too Big) and emits 'ErrReadLimitExceeded' through 'OnError'
+	ReadLimit int64
+	// I/O buffer sizes in bytes, 0 uses the default size (4096)
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Default is 45 seconds
+	HandshakeTimeout time.Duration
+
+	// permessage-deflate negotiation, disabled by default
+	Compression CompressionOptions
+
+	// Subprotocols requested through 'Sec-WebSocket-Protocol', in order of preference
+	Subprotocols []string
+
+	// Inbound messages bigger than this amount of bytes are delivered through 'OnMessageStream' (when set), 0 uses STREAM_THRESHOLD_BYTES
+	//
+	// Like 'ReadLimit', it must be at least FILE_TRANSFER_MAX_FRAME_SIZE for the client to receive files
+	StreamThreshold int
 }
 
 type Client struct {
 	base *websockets.ReconnectingRegisteredCallbacksWebsocket
 
 	OnMessage func(messageType int, msg []byte)
+	// Called instead of OnMessage for messages bigger than the stream threshold, so that they are never buffered whole
+	//
+	// The message must be read from 'reader' before returning, whatever is left unread is discarded. Streamed messages skip the parsers
+	OnMessageStream func(messageType int, reader io.Reader)
 
 	// Called on any error that originates from the current established connection.
 	//
@@ -29,55 +84,231 @@ type Client struct {
 	OnError func(err error)
 
 	// Called once the connection unexpectedly drops, expect to be reconnected shortly after
-	OnDisconnect func(code int, reason string)
+	OnDisconnect func(info CloseInfo)
 
 	OnReconnectError func(err error)
-	// Called once a new connection is established after disconnection
-	OnReconnect func()
+	// Called once a new connection is established after disconnection (or after switching back to the primary endpoint)
+	//
+	// 'endpoint' is the URL the client is now connected to
+	OnReconnect func(endpoint string)
+
+	// Called on every state transition, see 'State()'
+	//
+	// NOTE: The first Connecting -> Open transition happens within 'NewClient()', so it is never emitted
+	OnStateChange func(old State, new State)
+
+	// Called once the client has been manually closed, after the close handshake completed (or timed out)
+	OnClose func(info CloseInfo)
+
+	// Called when the server offers a file, return where to write it, or an error to reject it (transfers are rejected while unset)
+	//
+	// Not called again when an interrupted transfer is resumed
+	OnFileOffer func(transfer FileTransfer) (io.WriterAt, error)
+	// Called every time a chunk is acknowledged, in both directions
+	OnFileProgress func(transfer FileTransfer)
+	// Called once an incoming file has been fully written
+	OnFileReceived func(transfer FileTransfer)
+
+	// Called once reconnected when the server resumed the session, before the missed messages are replayed, see 'WithSessionResumption()'
+	OnResume func(info ResumeInfo)
+	// Called once reconnected when the session could not be resumed (it expired on the server), a new one was started without the previous one's state
+	OnSessionLost func()
+
+	files fileTransfers
+	// nil unless created with 'WithSessionResumption()'
+	session *clientSession
+
+	// Called for every message sent through the server's 'Connection.SendReliable()', duplicates are dropped
+	//
+	// The message is acknowledged once this returns
+	OnReliableMessage func(messageId string, msg []byte)
+	// Called when a message sent through 'SendReliable()' can't be delivered, 'err' wraps ErrDeliveryFailed
+	OnDeliveryFailed func(messageId string, msg []byte, err error)
+
+	// Called when a callback panics, the panic is recovered so that it doesn't crash the process and the client keeps going
+	OnPanic func(recovered interface{}, stack []byte)
+
+	reliable *reliableChannel
 }
 
 func (socket *Client) init(baseSocket *websockets.ReconnectingRegisteredCallbacksWebsocket) {
 	socket.base = baseSocket
 
 	socket.base.OnMessage = socket.onMessage
+	socket.base.OnMessageStream = socket.onMessageStream
 	socket.base.OnError = socket.onError
 	socket.base.OnDisconnect = socket.onDisconnect
 	socket.base.OnReconnectError = socket.onReconnectError
 	socket.base.OnReconnect = socket.onReconnect
+	socket.base.OnStateChange = socket.onStateChange
+	socket.base.OnClose = socket.onClose
+
+	socket.files.init(socket, newIncomingFileTransfers())
 }
 
 func (socket *Client) onMessage(messageType int, msg []byte) {
+	if messageType == ws.BinaryMessage && (socket.files.handleFrame(msg) || socket.reliable.handleFrame(msg)) {
+		return
+	}
+
+	// Already handled by the session, see 'clientSession.onReceive()'
+	if socket.session != nil {
+		if _, isSessionFrame := decodeSessionFrame(messageType, msg); isSessionFrame {
+			return
+		}
+	}
+
 	if socket.OnMessage != nil {
 		socket.OnMessage(messageType, msg)
 	}
 }
 
+func (socket *Client) onMessageStream(messageType int, reader io.Reader) bool {
+	if socket.OnMessageStream == nil {
+		return false
+	}
+
+	socket.OnMessageStream(messageType, reader)
+	return true
+}
+
 func (socket *Client) onError(err error) {
 	if socket.OnError != nil {
 		socket.OnError(err)
 	}
 }
 
-func (socket *Client) onDisconnect(code int, reason string) {
+func (socket *Client) onDisconnect(info CloseInfo) {
+	socket.files.disconnected()
+
+	defer socket.recoverPanic()
+
 	if socket.OnDisconnect != nil {
-		socket.OnDisconnect(code, reason)
+		socket.OnDisconnect(info)
 	}
 }
 
 func (socket *Client) onReconnectError(err error) {
+	defer socket.recoverPanic()
+
 	if socket.OnReconnectError != nil {
 		socket.OnReconnectError(err)
 	}
 }
 
-func (socket *Client) onReconnect() {
+func (socket *Client) onReconnect(endpoint string) {
+	socket.reliable.resend()
+
+	defer socket.recoverPanic()
+
 	if socket.OnReconnect != nil {
-		socket.OnReconnect()
+		socket.OnReconnect(endpoint)
+	}
+}
+
+func (socket *Client) onStateChange(old State, new State) {
+	defer socket.recoverPanic()
+
+	if socket.OnStateChange != nil {
+		socket.OnStateChange(old, new)
+	}
+}
+
+func (socket *Client) onClose(info CloseInfo) {
+	socket.reliable.close(ErrSocketClosed)
+
+	defer socket.recoverPanic()
+
+	if socket.OnClose != nil {
+		socket.OnClose(info)
+	}
+}
+
+func (socket *Client) onResume(info ResumeInfo) {
+	defer socket.recoverPanic()
+
+	if socket.OnResume != nil {
+		socket.OnResume(info)
+	}
+}
+
+func (socket *Client) onSessionLost() {
+	defer socket.recoverPanic()
+
+	if socket.OnSessionLost != nil {
+		socket.OnSessionLost()
+	}
+}
+
+// Returns false while no 'OnReliableMessage' is set, the message is then left unacknowledged to be retransmitted
+func (socket *Client) onReliableMessage(messageId string, msg []byte) (delivered bool) {
+	if socket.OnReliableMessage == nil {
+		return false
+	}
+
+	socket.OnReliableMessage(messageId, msg)
+	return true
+}
+
+func (socket *Client) onDeliveryFailed(messageId string, msg []byte, err error) {
+	defer socket.recoverPanic()
+
+	if socket.OnDeliveryFailed != nil {
+		socket.OnDeliveryFailed(messageId, msg, err)
+	}
+}
+
+func (socket *Client) sendReliableFrame(frame []byte) error {
+	return socket.SendBinary(frame)
+}
+
+func (socket *Client) onFileOffer(transfer FileTransfer) (io.WriterAt, error) {
+	if socket.OnFileOffer == nil {
+		return nil, nil
 	}
+
+	return socket.OnFileOffer(transfer)
+}
+
+func (socket *Client) onFileProgress(transfer FileTransfer) {
+	if socket.OnFileProgress != nil {
+		socket.OnFileProgress(transfer)
+	}
+}
+
+func (socket *Client) onFileReceived(transfer FileTransfer) {
+	if socket.OnFileReceived != nil {
+		socket.OnFileReceived(transfer)
+	}
+}
+
+func (socket *Client) sendFileFrame(frame []byte) error {
+	return socket.SendBinary(frame)
+}
+
+// A client only receives files from its server
+func (socket *Client) fileTransferOwner() string {
+	return ""
+}
+
+func (socket *Client) waitForReconnect(ctx context.Context) (*fileTransfers, error) {
+	return &socket.files, socket.WaitUntil(ctx, State_Open)
 }
 
 //// Public Methods
 
+// Returns the current state of the client (Connecting, Open, Reconnecting, Closing or Closed)
+func (socket *Client) State() State {
+	return socket.base.State()
+}
+
+// Blocks until the client reaches 'state'
+//
+// Returns ErrSocketClosed if the state can no longer be reached (the client was closed), or ctx.Err() if the context is done first
+func (socket *Client) WaitUntil(ctx context.Context, state State) error {
+	return socket.base.WaitUntil(ctx, state)
+}
+
 func (socket *Client) SetURL(URL string) {
 	socket.base.SetURL(URL)
 }
@@ -86,12 +317,22 @@ func (socket *Client) SetHTTPHeader(httpHeader http.Header) {
 	socket.base.SetHTTPHeader(httpHeader)
 }
 
+// Returns the URL the client is currently connected (or last connected) to
+func (socket *Client) GetActiveEndpoint() string {
+	return socket.base.GetActiveEndpoint()
+}
+
 //
 
 func (socket *Client) GetParserRegistry() *parser.MessageParsers_Registry {
 	return socket.base.GetParserRegistry()
 }
 
+// Returns the subprotocol negotiated with the server, empty if none
+func (socket *Client) GetSubprotocol() string {
+	return socket.base.GetSubprotocol()
+}
+
 //
 
 func (socket *Client) SendText(text string) error {
@@ -102,59 +343,119 @@ func (socket *Client) SendJSON(v interface{}) error {
 	return socket.base.SendJSON(v)
 }
 
+func (socket *Client) SendBinary(data []byte) error {
+	return socket.base.SendBinary(data)
+}
+
+// If the connection drops before the response arrives, an error wrapping 'ErrDisconnected' is returned immediately
 func (socket *Client) SendPrivateMessage(message map[string]interface{}, timeout_sec ...int) (response []byte, hasTimedOut bool, err error) {
 	return socket.base.SendPrivateMessage(message, timeout_sec...)
 }
 
+// Same as 'SendPrivateMessage()', except that if the connection drops before the response arrives, the request is transparently resent once reconnected
+//
+// NOTE: The timeout covers the whole exchange, including the time spent reconnecting
+//
+// WARNING: Only use this for idempotent requests, the server may have processed the request before the connection dropped
+func (socket *Client) SendIdempotentPrivateMessage(message map[string]interface{}, timeout_sec ...int) (response []byte, hasTimedOut bool, err error) {
+	return socket.base.SendIdempotentPrivateMessage(message, timeout_sec...)
+}
+
+// Sends a file in chunks, blocking until the server has acknowledged all of it
+//
+// # If the connection drops, the transfer is resumed from the last acknowledged offset once reconnected
+//
+// 'transferId' identifies the transfer on the server, defaults to a random id
+func (socket *Client) SendFile(ctx context.Context, name string, reader io.ReaderAt, size int64, transferId ...string) error {
+	id := newTransferId()
+	if len(transferId) != 0 {
+		id = transferId[0]
+	}
+
+	return socket.files.sendFile(ctx, name, reader, size, id)
+}
+
+// Sends a message that is retransmitted until the server acknowledges it, including after reconnecting, and returns its id
+//
+// Delivered to 'Connection.OnReliableMessage' at least once, duplicates within the server's dedup window are dropped. 'OnDeliveryFailed' is called if the message is given up on
+//
+// 'messageId' defaults to a random id, it must be unique among the messages sent recently
+func (socket *Client) SendReliable(msg []byte, messageId ...string) (string, error) {
+	id := newTransferId()
+	if len(messageId) != 0 {
+		id = messageId[0]
+	}
+
+	return id, socket.reliable.send(id, msg)
+}
+
 func (socket *Client) SendPreparedMessage(preparedMessage *ws.PreparedMessage) error {
 	return socket.base.SendPreparedMessage(preparedMessage)
 }
 
+// Returns a writer streaming a single message of 'messageType', sent as it is written and completed once the writer is closed
+//
+// Every other send blocks until the writer is closed, so always close it
+func (socket *Client) NewWriter(messageType int) (io.WriteCloser, error) {
+	return socket.base.NewWriter(messageType)
+}
+
+// Same as 'CloseWithCode()' with 1000 (Normal Closure)
 func (socket *Client) Close() {
 	socket.base.Close()
 }
 
-////
-
-func NewClient(URL string, opt_params ...Client_params) (*Client, error) {
-	var headers http.Header
-	var privateRequestPropertyName = "id"
-
-	if len(opt_params) != 0 {
-		params := opt_params[0]
+// Stops reconnecting and sends a close frame with the given code and reason
+//
+// The state stays Closing until the server answers (or CLOSE_HANDSHAKE_TIMEOUT_SEC elapses), then becomes Closed and OnClose is called
+func (socket *Client) CloseWithCode(code int, reason string) error {
+	return socket.base.CloseWithCode(code, reason)
+}
 
-		// Preparing the URL
-		u, err := url.Parse(URL)
-		if err != nil {
-			return nil, err
-		}
+////
 
-		q := u.Query()
-		for key, value := range params.query {
-			q.Set(key, value)
-		}
-		u.RawQuery = q.Encode()
+// Accepts any combination of 'With...' options and 'Client_params', applied in order
+//
+//	client, err := gows.NewClient("wss://example.com/ws",
+//		gows.WithQuery("token", "abc"),
+//		gows.WithHeader("Authorization", "Bearer xyz"),
+//		gows.WithHandshakeTimeout(10*time.Second),
+//	)
+func NewClient(URL string, options ...ClientOption) (*Client, error) {
+	config := newClientConfig()
+	for _, option := range options {
+		option.applyClientOption(config)
+	}
 
-		URL = u.String()
+	_, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
 
-		// Handling headers
-		if params.headers != nil {
-			headers = params.headers
-		}
+	checkFileTransferLimits(config.readLimit, config.streamThreshold)
 
-		// Handling private request property name
-		if params.PrivateRequestPropertyName != "" {
-			privateRequestPropertyName = params.PrivateRequestPropertyName
-		}
+	var socket Client
+	socket.reliable = newReliableChannel(&socket, config.reliableOptions)
+	// Kept across reconnections, so that the server hands the client's reliable stream over to the new connection
+	config.headers.Set(STREAM_HEADER, newTransferId())
+	config.onPanic = socket.onPanic
+	if config.sessionResumption {
+		socket.session = &clientSession{client: &socket}
+		config.headerProvider = socket.session.headerProvider(config.headerProvider)
+		config.onReceive = socket.session.onReceive
 	}
 
-	baseSocket, err := websockets.CreateReconnectingRegisteredCallbacksWebsocket(URL, privateRequestPropertyName, false, headers)
+	// Not reading until the callbacks are set, the server may send right away (e.g. the messages replayed on a resumed session)
+	dialOptions := config.dialOptions()
+	dialOptions.ManualStart = true
+
+	baseSocket, err := websockets.CreateReconnectingRegisteredCallbacksWebsocket(URL, config.privateRequestPropertyName, false, config.headers, dialOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	var socket Client
 	socket.init(baseSocket)
+	baseSocket.Start()
 
 	return &socket, err
 }
@@ -0,0 +1,305 @@
+package gows
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/GTedZ/gows/websockets"
+	ws "github.com/gorilla/websocket"
+)
+
+// Configures a Client created through 'NewClient()', see the 'With...' functions
+//
+// 'Client_params' is also a ClientOption
+type ClientOption interface {
+	applyClientOption(config *clientConfig)
+}
+
+type EndpointStrategy = websockets.EndpointStrategy
+
+const (
+	// Every connection attempt moves on to the next endpoint
+	EndpointStrategy_RoundRobin = websockets.EndpointStrategy_RoundRobin
+	// Every reconnection starts from the primary (first) endpoint and falls back down the list, switching back to the primary once it's reachable again
+	EndpointStrategy_Priority = websockets.EndpointStrategy_Priority
+	// Endpoints are tried from the lowest to the highest measured latency
+	EndpointStrategy_LowestLatency = websockets.EndpointStrategy_LowestLatency
+)
+
+type clientOptionFunc func(config *clientConfig)
+
+func (option clientOptionFunc) applyClientOption(config *clientConfig) {
+	option(config)
+}
+
+type clientConfig struct {
+	privateRequestPropertyName string
+
+	query   url.Values
+	headers http.Header
+
+	dialer          ws.Dialer
+	readLimit       int64
+	compression     CompressionOptions
+	streamThreshold int
+
+	endpoints              []string
+	endpointStrategy       EndpointStrategy
+	primaryRecheckInterval time.Duration
+
+	urlProvider    func(ctx context.Context) (string, error)
+	headerProvider func(ctx context.Context) (http.Header, error)
+
+	sessionResumption bool
+	onReceive         func(messageType int, msg []byte)
+	onPanic           func(recovered interface{}, stack []byte)
+
+	reliableOptions ReliableOptions
+}
+
+func newClientConfig() *clientConfig {
+	return &clientConfig{
+		privateRequestPropertyName: "id",
+
+		query:   url.Values{},
+		headers: http.Header{},
+
+		dialer: *ws.DefaultDialer,
+	}
+}
+
+func (config *clientConfig) dialOptions() websockets.DialOptions {
+	dialer := config.dialer
+
+	var dialOptions websockets.DialOptions
+	dialOptions.Dialer = &dialer
+	dialOptions.Query = config.query
+	dialOptions.ReadLimit = config.readLimit
+	dialOptions.Compression = config.compression
+	dialOptions.StreamThreshold = config.streamThreshold
+	dialOptions.Endpoints = config.endpoints
+	dialOptions.EndpointStrategy = config.endpointStrategy
+	dialOptions.PrimaryRecheckInterval = config.primaryRecheckInterval
+	dialOptions.URLProvider = config.urlProvider
+	dialOptions.HeaderProvider = config.headerProvider
+	dialOptions.OnReceive = config.onReceive
+	dialOptions.ReservedPrefixes = protocolFrameMagics
+	dialOptions.OnPanic = config.onPanic
+
+	return dialOptions
+}
+
+//// Client_params
+
+func (params Client_params) applyClientOption(config *clientConfig) {
+	for key, value := range params.Query {
+		config.query.Set(key, value)
+	}
+	for key, values := range params.Headers {
+		config.headers[key] = values
+	}
+
+	if params.PrivateRequestPropertyName != "" {
+		config.privateRequestPropertyName = params.PrivateRequestPropertyName
+	}
+
+	if params.ReadLimit > 0 {
+		config.readLimit = params.ReadLimit
+	}
+	if params.ReadBufferSize > 0 {
+		config.dialer.ReadBufferSize = params.ReadBufferSize
+	}
+	if params.WriteBufferSize > 0 {
+		config.dialer.WriteBufferSize = params.WriteBufferSize
+	}
+	if params.HandshakeTimeout > 0 {
+		config.dialer.HandshakeTimeout = params.HandshakeTimeout
+	}
+
+	if params.Compression.Enabled {
+		WithCompression(params.Compression).applyClientOption(config)
+	}
+	if len(params.Subprotocols) != 0 {
+		config.dialer.Subprotocols = params.Subprotocols
+	}
+	if params.StreamThreshold > 0 {
+		config.streamThreshold = params.StreamThreshold
+	}
+}
+
+//// Options
+
+// Default is "id"
+func WithPrivateRequestPropertyName(propertyName string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.privateRequestPropertyName = propertyName
+	})
+}
+
+// Sets a query parameter on the URL, re-applied on every reconnection
+func WithQuery(key string, value string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.query.Set(key, value)
+	})
+}
+
+// Sets multiple query parameters on the URL, re-applied on every reconnection
+func WithQueryParams(params map[string]string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		for key, value := range params {
+			config.query.Set(key, value)
+		}
+	})
+}
+
+// Adds an HTTP header to the handshake, re-applied on every reconnection
+func WithHeader(key string, value string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.headers.Add(key, value)
+	})
+}
+
+// Adds multiple HTTP headers to the handshake, re-applied on every reconnection
+func WithHeaders(headers http.Header) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		for key, values := range headers {
+			for _, value := range values {
+				config.headers.Add(key, value)
+			}
+		}
+	})
+}
+
+// Cookies from the jar are sent with every handshake, and cookies set by the server's handshake responses are stored in it
+func WithCookieJar(jar http.CookieJar) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.Jar = jar
+	})
+}
+
+// Default is 45 seconds
+func WithHandshakeTimeout(timeout time.Duration) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.HandshakeTimeout = timeout
+	})
+}
+
+// Default is http.ProxyFromEnvironment, use http.ProxyURL() for a fixed proxy or nil to disable proxies
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.Proxy = proxy
+	})
+}
+
+// Uses a custom net.Dialer to open the TCP connections (local address, keep-alive, resolver...)
+func WithNetDialer(netDialer *net.Dialer) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.NetDialContext = netDialer.DialContext
+	})
+}
+
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.TLSClientConfig = tlsConfig
+	})
+}
+
+// I/O buffer sizes in bytes, 0 keeps the default size (4096)
+func WithBufferSizes(readBufferSize int, writeBufferSize int) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.ReadBufferSize = readBufferSize
+		config.dialer.WriteBufferSize = writeBufferSize
+	})
+}
+
+// Maximum size in bytes of an inbound message, 0 means unlimited
+//
+// A bigger message closes the connection with 1009 (Message Too Big) and emits 'ErrReadLimitExceeded' through 'OnError'
+func WithReadLimit(limit int64) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.readLimit = limit
+	})
+}
+
+// permessage-deflate negotiation, disabled by default
+func WithCompression(compression CompressionOptions) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.compression = compression
+		config.dialer.EnableCompression = compression.Enabled
+	})
+}
+
+// Inbound messages bigger than this amount of bytes are delivered through 'Client.OnMessageStream' (when set), default is STREAM_THRESHOLD_BYTES
+func WithStreamThreshold(threshold int) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.streamThreshold = threshold
+	})
+}
+
+// Connects to one of several equivalent endpoints, rotating between them across connection attempts according to 'strategy'
+//
+// The endpoints replace the URL passed to 'NewClient()', which can be left empty
+func WithEndpoints(strategy EndpointStrategy, endpoints ...string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.endpoints = endpoints
+		config.endpointStrategy = strategy
+	})
+}
+
+// Interval at which 'EndpointStrategy_Priority' re-checks the primary endpoint while connected to a fallback
+//
+// Default is 30 seconds, a negative interval disables the re-check
+func WithPrimaryRecheckInterval(interval time.Duration) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.primaryRecheckInterval = interval
+	})
+}
+
+// Called before every connection attempt (including the first one), the returned URL replaces the one passed to 'NewClient()'
+//
+// Useful for URLs that must be freshly signed on each connection, an error fails 'NewClient()' on the first connection, then is emitted through 'OnReconnectError' and retried on reconnections
+//
+// 'ctx' is cancelled once the client is closed
+func WithURLProvider(provider func(ctx context.Context) (string, error)) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.urlProvider = provider
+	})
+}
+
+// Called before every connection attempt (including the first one), the returned headers are added to (and override) the static ones
+//
+// Useful for auth headers that must be renewed on each connection, an error fails 'NewClient()' on the first connection, then is emitted through 'OnReconnectError' and retried on reconnections
+//
+// 'ctx' is cancelled once the client is closed
+func WithHeaderProvider(provider func(ctx context.Context) (http.Header, error)) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.headerProvider = provider
+	})
+}
+
+// Subprotocols requested through 'Sec-WebSocket-Protocol', in order of preference
+func WithSubprotocols(subprotocols ...string) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.dialer.Subprotocols = subprotocols
+	})
+}
+
+// Resumes the client's session whenever it reconnects to a server with 'Server_Params.Sessions' enabled
+//
+// The messages sent while disconnected are replayed (see 'Client.OnResume'), and the server restores the connection's id, 'Data' and rooms
+func WithSessionResumption() ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.sessionResumption = true
+	})
+}
+
+// Ack timeout, retransmission attempts and dedup window of the reliable messages, see 'Client.SendReliable()'
+func WithReliableOptions(options ReliableOptions) ClientOption {
+	return clientOptionFunc(func(config *clientConfig) {
+		config.reliableOptions = options
+	})
+}
@@ -0,0 +1,74 @@
+package gows
+
+import (
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Default broker channel the servers of a cluster broadcast on, see 'Server_Params.BrokerChannel'
+const CLUSTER_CHANNEL = "gows.broadcast"
+
+// Published on the broker by 'Broadcast()' and 'BroadcastToRoom()'
+type clusterMessage struct {
+	// Id of the publishing node, which already delivered the message to its own connections
+	Node string `json:"node"`
+	// Empty for a broadcast to every connection
+	Room string `json:"room,omitempty"`
+	Data []byte `json:"data"`
+}
+
+// Subscribes to the broker's channel, once, called before serving
+func (server *Server) subscribeBroker() error {
+	server.brokerMu.Lock()
+	defer server.brokerMu.Unlock()
+
+	if server.broker == nil || server.brokerSubscription != nil {
+		return nil
+	}
+
+	subscription, err := server.broker.Subscribe(server.brokerChannel, server.onClusterMessage)
+	if err != nil {
+		return err
+	}
+	server.brokerSubscription = subscription
+
+	return nil
+}
+
+// Publishes a message already delivered to the local connections, so that the other nodes deliver it to theirs
+func (server *Server) publish(room string, data []byte) error {
+	if server.broker == nil {
+		return nil
+	}
+
+	message, err := jsoniter.Marshal(clusterMessage{Node: server.nodeId, Room: room, Data: data})
+	if err != nil {
+		return err
+	}
+
+	return server.broker.Publish(server.brokerChannel, message)
+}
+
+func (server *Server) onClusterMessage(msg []byte) {
+	var message clusterMessage
+	err := jsoniter.Unmarshal(msg, &message)
+	if err != nil || message.Node == server.nodeId {
+		return
+	}
+
+	preparedMessage, err := websocket.NewPreparedMessage(websocket.TextMessage, message.Data)
+	if err != nil {
+		return
+	}
+
+	if message.Room == "" {
+		server.broadcastLocal(preparedMessage, message.Data)
+	} else {
+		server.broadcastLocalToRoom(message.Room, preparedMessage, message.Data)
+	}
+}
+
+// Returns the id the server publishes its broadcasts with, see 'Server_Params.NodeID'
+func (server *Server) NodeID() string {
+	return server.nodeId
+}
@@ -1,7 +1,11 @@
 package gows
 
 import (
+	"context"
+	"io"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 
 	"github.com/GTedZ/gows/parser"
@@ -14,22 +18,75 @@ type Connection struct {
 	base   *websockets.RegisteredCallbacksWebsocket
 	parent *Server
 
-	connectionId int
+	connectionId string
+	remoteIP     string
+	principal    string
 
 	Request *http.Request
 
 	Data connectionData
 
+	rateLimiter connectionRateLimiter
+	codec       Codec
+
 	OnRequest func(msg []byte, request *ResponseHandler)
 	OnMessage func(messageType int, msg []byte)
-	OnError   func(err error)
-	OnClose   func(code int, reason string)
-}
+	// Called instead of OnMessage for messages bigger than the stream threshold, so that they are never buffered whole
+	//
+	// The message must be read from 'reader' before returning, whatever is left unread is discarded. Streamed messages skip the parsers and private requests, the byte rate limit paces their reading
+	OnMessageStream func(messageType int, reader io.Reader)
+	OnError         func(err error)
+	// 'info' tells whether the close was initiated locally or by the client, and whether the close handshake completed
+	OnClose func(info CloseInfo)
+
+	// Called when the client offers a file, return where to write it, or an error to reject it (transfers are rejected while unset)
+	//
+	// Not called again when an interrupted transfer is resumed
+	OnFileOffer func(transfer FileTransfer) (io.WriterAt, error)
+	// Called every time a chunk is acknowledged, in both directions
+	OnFileProgress func(transfer FileTransfer)
+	// Called once an incoming file has been fully written
+	OnFileReceived func(transfer FileTransfer)
 
-func (connection *Connection) init(parent *Server, conn *ws.Conn, r *http.Request, privateMessagePropertyName string, connectionId int) {
-	connection.base = websockets.AssignRegisteredCallbacksWebsocket(conn, "", privateMessagePropertyName, true)
+	files fileTransfers
+
+	// Called for every message sent through the client's 'SendReliable()', duplicates are dropped
+	//
+	// The message is acknowledged once this returns, it is left unacknowledged (and retransmitted) while this is unset
+	//
+	// Duplicates are remembered by the client's stream (see STREAM_HEADER), across its reconnections
+	OnReliableMessage func(messageId string, msg []byte)
+	// Called when a message sent through 'SendReliable()' can't be delivered, 'err' wraps ErrDeliveryFailed
+	OnDeliveryFailed func(messageId string, msg []byte, err error)
+
+	// Handed over to the next connection of the same stream, or when a session is resumed
+	reliable *reliableChannel
+	// Id of the client's stream, empty for the clients that didn't send one (e.g. not a gows Client)
+	reliableStream string
+	// See 'SetPresence()', guarded by the server's presence tracker
+	presenceMeta   PresenceMeta
+	presenceClosed bool
+
+	// nil unless the client asked for a resumable session
+	session    *session
+	resumed    bool
+	resumeInfo ResumeInfo
+}
+
+// Prefixes of the binary frames handled by 'onMessage()' (and 'Client.onMessage()') before anything else, the parsers never see them
+var protocolFrameMagics = [][]byte{fileFrameMagic, reliableFrameMagic, sessionFrameMagic}
+
+// The socket doesn't read until 'start()' is called, once the server has finished setting the connection up
+func (connection *Connection) init(parent *Server, conn *ws.Conn, r *http.Request, privateMessagePropertyName string, connectionId string, remoteIP string, principal string) {
+	options := parent.socketOptions
+	options.OnPanic = connection.onPanic
+	options.ManualStart = true
+	options.ReservedPrefixes = protocolFrameMagics
+	connection.base = websockets.AssignRegisteredCallbacksWebsocket(conn, "", privateMessagePropertyName, true, options)
 	connection.parent = parent
 	connection.connectionId = connectionId
+	connection.remoteIP = remoteIP
+	connection.principal = principal
 
 	connection.Request = r
 
@@ -37,15 +94,27 @@ func (connection *Connection) init(parent *Server, conn *ws.Conn, r *http.Reques
 
 	connection.Data.init()
 
+	connection.rateLimiter.init(parent.messageRateLimit, parent.requestRateLimit)
+	connection.base.InterceptMessage = connection.interceptMessage
+	connection.base.InterceptMessageStream = connection.interceptMessageStream
+
 	//
 
 	connection.base.OnMessage = connection.onMessage
+	connection.base.OnMessageStream = connection.onMessageStream
 	connection.base.OnError = connection.onError
 	connection.base.OnClose = connection.onClose
+
+	connection.files.init(connection, parent.incomingFiles)
+	connection.reliable = newReliableChannel(connection, parent.reliableOptions)
 }
 
 func (connection *Connection) onMessage(messageType int, msg []byte) {
-	requestId, isRequest := websockets.CheckMessageIsPrivate(msg, connection.parent.privateMessagePropertyName)
+	if messageType == ws.BinaryMessage && (connection.files.handleFrame(msg) || connection.reliable.handleFrame(msg)) {
+		return
+	}
+
+	requestId, isRequest := websockets.CheckMessageTypeIsPrivate(messageType, msg, connection.parent.privateMessagePropertyName)
 	if isRequest {
 		connection.onRequest(requestId, msg)
 		return
@@ -56,18 +125,112 @@ func (connection *Connection) onMessage(messageType int, msg []byte) {
 	}
 }
 
+func (connection *Connection) onMessageStream(messageType int, reader io.Reader) bool {
+	if connection.OnMessageStream == nil {
+		return false
+	}
+
+	connection.OnMessageStream(messageType, reader)
+	return true
+}
+
 func (connection *Connection) onError(err error) {
 	if connection.OnError != nil {
 		connection.OnError(err)
 	}
 }
 
-func (connection *Connection) onClose(code int, reason string) {
-	connection.parent.onConnectionClose(connection, code, reason)
+func (connection *Connection) onClose(info CloseInfo) {
+	connection.files.disconnected()
+	// A stream or session keeps its pending messages until it expires
+	if connection.reliableStream != "" {
+		connection.parent.reliableStreams.detach(connection)
+	} else if connection.session == nil {
+		connection.reliable.close(ErrDisconnected)
+	}
+
+	connection.parent.onConnectionClose(connection, info)
 
 	if connection.OnClose != nil {
-		connection.OnClose(code, reason)
+		connection.OnClose(info)
+	}
+}
+
+func (connection *Connection) onFileOffer(transfer FileTransfer) (io.WriterAt, error) {
+	if connection.OnFileOffer == nil {
+		return nil, nil
+	}
+
+	return connection.OnFileOffer(transfer)
+}
+
+func (connection *Connection) onFileProgress(transfer FileTransfer) {
+	if connection.OnFileProgress != nil {
+		connection.OnFileProgress(transfer)
+	}
+}
+
+func (connection *Connection) onFileReceived(transfer FileTransfer) {
+	if connection.OnFileReceived != nil {
+		connection.OnFileReceived(transfer)
+	}
+}
+
+func (connection *Connection) sendFileFrame(frame []byte) error {
+	return connection.sequenced(ws.BinaryMessage, nil, false, func(target *Connection) error {
+		return target.base.SendBinary(frame)
+	})
+}
+
+// Returns false while no 'OnReliableMessage' is set, the message is then left unacknowledged to be retransmitted
+func (connection *Connection) onReliableMessage(messageId string, msg []byte) (delivered bool) {
+	if connection.OnReliableMessage == nil {
+		return false
+	}
+
+	connection.OnReliableMessage(messageId, msg)
+	return true
+}
+
+func (connection *Connection) onDeliveryFailed(messageId string, msg []byte, err error) {
+	defer connection.parent.recoverPanic(connection)
+
+	if connection.OnDeliveryFailed != nil {
+		connection.OnDeliveryFailed(messageId, msg, err)
+	}
+}
+
+// Reliable frames are retransmitted rather than replayed
+func (connection *Connection) sendReliableFrame(frame []byte) error {
+	return connection.sequenced(ws.BinaryMessage, nil, false, func(target *Connection) error {
+		return target.base.SendBinary(frame)
+	})
+}
+
+// Its principal, so that only the same principal can resume its uploads. Without one, its client's stream id (see STREAM_HEADER), or its id when it has neither (kept by a resumed session)
+func (connection *Connection) fileTransferOwner() string {
+	switch {
+	case connection.principal != "":
+		return "principal:" + connection.principal
+	case connection.reliableStream != "":
+		return "stream:" + connection.reliableStream
+	}
+
+	return "connection:" + connection.connectionId
+}
+
+// Waits for the client's next connection of the same stream (see STREAM_HEADER), the transfer is resumed through it
+func (connection *Connection) waitForReconnect(ctx context.Context) (*fileTransfers, error) {
+	if connection.reliableStream == "" {
+		return nil, ErrDisconnected
+	}
+
+	next, err := connection.parent.reliableStreams.next(ctx, connection)
+	if err != nil {
+		return nil, err
 	}
+
+	return &next.files, nil
 }
 
 //// Response Handler
@@ -110,10 +273,35 @@ func (connection *Connection) onRequest(requestId string, msg []byte) {
 
 //// Public Methods
 
-func (connection *Connection) GetId() int {
+func (connection *Connection) GetId() string {
 	return connection.connectionId
 }
 
+// Returns the client's IP, resolved through the server's trusted proxy headers if any
+func (connection *Connection) GetRemoteIP() string {
+	return connection.remoteIP
+}
+
+// Returns the principal resolved by the server's 'PrincipalResolver', empty if none
+func (connection *Connection) GetPrincipal() string {
+	return connection.principal
+}
+
+// Returns the subprotocol negotiated during the handshake, empty if none
+func (connection *Connection) GetSubprotocol() string {
+	return connection.base.GetSubprotocol()
+}
+
+// Returns whether the connection resumed a previous session of the client, in which case its 'Data', rooms and id were restored from it
+func (connection *Connection) Resumed() (info ResumeInfo, resumed bool) {
+	return connection.resumeInfo, connection.resumed
+}
+
+// Returns the connection's statistics (connect time, last heartbeat, latency and message counters)
+func (connection *Connection) GetStats() websockets.Stats {
+	return connection.base.GetStats()
+}
+
 //// Connection Data
 
 type connectionData struct {
@@ -123,6 +311,11 @@ type connectionData struct {
 	floats     map[string]float64
 	strings    map[string]string
 	interfaces map[string]interface{}
+	// Values set through a 'Key[T]', keyed by the Key itself so that keys of different types never collide
+	keys map[any]interface{}
+
+	// Called (with the lock held) after every change, used to keep the server's indexes up to date
+	onChange func(key string)
 }
 
 func (connData *connectionData) init() {
@@ -131,6 +324,98 @@ func (connData *connectionData) init() {
 	connData.floats = make(map[string]float64)
 	connData.strings = make(map[string]string)
 	connData.interfaces = make(map[string]interface{})
+	connData.keys = make(map[any]interface{})
+}
+
+// Must be called with the lock held
+func (connData *connectionData) notify(key string) {
+	if connData.onChange != nil {
+		connData.onChange(key)
+	}
+}
+
+// Returns every value stored under 'key', across all types
+//
+// Must be called with the lock held
+func (connData *connectionData) valuesOf(key string) (values []interface{}) {
+	if value, exists := connData.bools[key]; exists {
+		values = append(values, value)
+	}
+	if value, exists := connData.ints[key]; exists {
+		values = append(values, value)
+	}
+	if value, exists := connData.floats[key]; exists {
+		values = append(values, value)
+	}
+	if value, exists := connData.strings[key]; exists {
+		values = append(values, value)
+	}
+	if value, exists := connData.interfaces[key]; exists {
+		values = append(values, value)
+	}
+	for typedKey, value := range connData.keys {
+		if typedKey.(namedKey).Name() == key {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// Returns a copy of every stored value, grouped by type, the values set through a 'Key[T]' are grouped under "keys" by key name
+//
+// NOTE: Only the maps are copied, pointers stored as values are shared
+func (connData *connectionData) Snapshot() map[string]interface{} {
+	connData.mu.Lock()
+	defer connData.mu.Unlock()
+
+	keys := make(map[string]interface{}, len(connData.keys))
+	for key, value := range connData.keys {
+		keys[key.(namedKey).Name()] = value
+	}
+
+	return map[string]interface{}{
+		"bools":      maps.Clone(connData.bools),
+		"ints":       maps.Clone(connData.ints),
+		"floats":     maps.Clone(connData.floats),
+		"strings":    maps.Clone(connData.strings),
+		"interfaces": maps.Clone(connData.interfaces),
+		"keys":       keys,
+	}
+}
+
+// Copies every value of 'previous' (the connection a session is resumed from), before the connection is registered
+func (connData *connectionData) restore(previous *connectionData) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+
+	connData.mu.Lock()
+	defer connData.mu.Unlock()
+
+	connData.bools = maps.Clone(previous.bools)
+	connData.ints = maps.Clone(previous.ints)
+	connData.floats = maps.Clone(previous.floats)
+	connData.strings = maps.Clone(previous.strings)
+	connData.interfaces = maps.Clone(previous.interfaces)
+	connData.keys = maps.Clone(previous.keys)
+}
+
+// Calls 'callback' for every value set through a 'Key[T]', until it returns false
+//
+// Iterates over a copy, so the callback is free to modify the connection's data
+func (connData *connectionData) Range(callback func(key string, value interface{}) bool) {
+	connData.mu.Lock()
+	keys := make(map[string]interface{}, len(connData.keys))
+	for key, value := range connData.keys {
+		keys[key.(namedKey).Name()] = value
+	}
+	connData.mu.Unlock()
+
+	for key, value := range keys {
+		if !callback(key, value) {
+			return
+		}
+	}
 }
 
 // Get a bool from a key-value store unique to each connection
@@ -152,6 +437,7 @@ func (connData *connectionData) SetBool(key string, value bool) {
 	defer connData.mu.Unlock()
 
 	connData.bools[key] = value
+	connData.notify(key)
 }
 
 // Clear a bool from a key-value store unique to each connection
@@ -162,6 +448,7 @@ func (connData *connectionData) ClearBool(key string) {
 	defer connData.mu.Unlock()
 
 	delete(connData.bools, key)
+	connData.notify(key)
 }
 
 //
@@ -185,6 +472,7 @@ func (connData *connectionData) SetInt(key string, value int64) {
 	defer connData.mu.Unlock()
 
 	connData.ints[key] = value
+	connData.notify(key)
 }
 
 // Used to clear an int from a key-value store unique to each connection
@@ -195,6 +483,7 @@ func (connData *connectionData) ClearInt(key string) {
 	defer connData.mu.Unlock()
 
 	delete(connData.ints, key)
+	connData.notify(key)
 }
 
 //
@@ -218,6 +507,7 @@ func (connData *connectionData) SetFloat(key string, value float64) {
 	defer connData.mu.Unlock()
 
 	connData.floats[key] = value
+	connData.notify(key)
 }
 
 // Used to clear a float from a key-value store unique to each connection
@@ -228,6 +518,7 @@ func (connData *connectionData) ClearFloat(key string) {
 	defer connData.mu.Unlock()
 
 	delete(connData.floats, key)
+	connData.notify(key)
 }
 
 //
@@ -251,6 +542,7 @@ func (connData *connectionData) SetString(key string, value string) {
 	defer connData.mu.Unlock()
 
 	connData.strings[key] = value
+	connData.notify(key)
 }
 
 // Used to clear a string from a key-value store unique to each connection
@@ -261,6 +553,7 @@ func (connData *connectionData) ClearString(key string) {
 	defer connData.mu.Unlock()
 
 	delete(connData.strings, key)
+	connData.notify(key)
 }
 
 //
@@ -284,6 +577,7 @@ func (connData *connectionData) SetInterface(key string, value interface{}) {
 	defer connData.mu.Unlock()
 
 	connData.interfaces[key] = value
+	connData.notify(key)
 }
 
 // Used to clear an interface from a key-value store unique to each connection
@@ -294,6 +588,7 @@ func (connData *connectionData) ClearInterface(key string) {
 	defer connData.mu.Unlock()
 
 	delete(connData.interfaces, key)
+	connData.notify(key)
 }
 
 //
@@ -304,28 +599,148 @@ func (connection *Connection) GetParserRegistry() *parser.MessageParsers_Registr
 
 //
 
+// Sends through 'send', numbering the message (and keeping it for replay if 'replayable') when the connection belongs to a session
+//
+// 'send' is given the session's current connection, so that messages sent through a connection the client has since resumed from still reach it
+//
+// 'data' is kept for replay as is, it must not be modified afterwards: a broadcast shares the same bytes across every session
+func (connection *Connection) sequenced(messageType int, data []byte, replayable bool, send func(target *Connection) error) error {
+	if connection.session == nil {
+		return send(connection)
+	}
+
+	return connection.session.send(connection, messageType, data, replayable, send)
+}
+
+// Sends a message prepared for a broadcast, 'data' is kept for the session's replay buffer
+func (connection *Connection) sendPrepared(preparedMessage *ws.PreparedMessage, data []byte) error {
+	return connection.sequenced(ws.TextMessage, data, true, func(target *Connection) error {
+		return target.base.SendPreparedMessage(preparedMessage)
+	})
+}
+
+// Within a session, the message is kept for replay and sent again if the client resumes, even if an error is returned
 func (connection *Connection) SendText(text string) error {
-	return connection.base.SendText(text)
+	return connection.sequenced(ws.TextMessage, []byte(text), true, func(target *Connection) error {
+		return target.base.SendText(text)
+	})
 }
 
 func (connection *Connection) SendJSON(v interface{}) error {
-	return connection.base.SendJSON(v)
+	if connection.session == nil {
+		return connection.base.SendJSON(v)
+	}
+
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return connection.SendText(string(data))
+}
+
+func (connection *Connection) SendBinary(data []byte) error {
+	// Kept for replay, while the caller may reuse its buffer
+	replayed := data
+	if connection.session != nil {
+		replayed = slices.Clone(data)
+	}
+
+	return connection.sequenced(ws.BinaryMessage, replayed, true, func(target *Connection) error {
+		return target.base.SendBinary(data)
+	})
+}
+
+// Encodes 'v' with the connection's codec (JSON unless its subprotocol specifies otherwise) and sends it
+func (connection *Connection) Send(v interface{}) error {
+	messageType, data, err := connection.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if messageType == ws.BinaryMessage {
+		return connection.SendBinary(data)
+	}
+
+	return connection.SendText(string(data))
 }
 
+// Decodes a message received on this connection with the connection's codec
+func (connection *Connection) Unmarshal(msg []byte, v interface{}) error {
+	return connection.codec.Unmarshal(msg, v)
+}
+
+// Sends a file in chunks, blocking until the client has acknowledged all of it
+//
+// If the connection drops, the transfer is resumed from the last acknowledged offset once the client reconnects, within 'ReliableOptions.StreamTTL'. Otherwise (or for the clients that don't send a stream id, see STREAM_HEADER) the returned error wraps ErrDisconnected, and the transfer can be resumed by calling 'SendFile()' with the same 'transferId' on the client's next connection
+//
+// 'transferId' defaults to a random id, pass one to be able to resume the transfer
+func (connection *Connection) SendFile(ctx context.Context, name string, reader io.ReaderAt, size int64, transferId ...string) error {
+	id := newTransferId()
+	if len(transferId) != 0 {
+		id = transferId[0]
+	}
+
+	return connection.files.sendFile(ctx, name, reader, size, id)
+}
+
+// Sends a message that is retransmitted until the client acknowledges it, and returns its id
+//
+// Delivered to 'Client.OnReliableMessage' at least once, duplicates within the client's dedup window are dropped. Pending messages are retransmitted once the client reconnects, and given up on (see 'OnDeliveryFailed') if it doesn't within 'ReliableOptions.StreamTTL'
+//
+// Clients that don't send a stream id (see STREAM_HEADER) only get them retransmitted when their session is resumed
+//
+// 'messageId' defaults to a random id, it must be unique among the messages sent recently
+func (connection *Connection) SendReliable(msg []byte, messageId ...string) (string, error) {
+	id := newTransferId()
+	if len(messageId) != 0 {
+		id = messageId[0]
+	}
+
+	return id, connection.reliable.send(id, msg)
+}
+
+// NOTE: Prepared messages can't be replayed to a resumed session, use 'SendText()' or 'SendBinary()' for that
 func (connection *Connection) SendPreparedMessage(message *ws.PreparedMessage) error {
-	return connection.base.SendPreparedMessage(message)
+	return connection.sequenced(ws.TextMessage, nil, false, func(target *Connection) error {
+		return target.base.SendPreparedMessage(message)
+	})
 }
 
+// Returns a writer streaming a single message of 'messageType', sent as it is written and completed once the writer is closed (it can't be replayed to a resumed session)
+//
+// Every other send (including broadcasts) blocks until the writer is closed, so always close it
+func (connection *Connection) NewWriter(messageType int) (writer io.WriteCloser, err error) {
+	err = connection.sequenced(messageType, nil, false, func(target *Connection) error {
+		writer, err = target.base.NewWriter(messageType)
+		return err
+	})
+
+	return writer, err
+}
+
+// Same as 'CloseWithCode()' with 1000 (Normal Closure)
 func (connection *Connection) Close() {
-	connection.base.Close()
+	connection.CloseWithCode(ws.CloseNormalClosure, "Normal Closure")
+}
+
+// Sends a close frame with the given code and reason, the connection is dropped once the client answers (or after CLOSE_HANDSHAKE_TIMEOUT_SEC)
+//
+// OnClose is only called once the connection has been dropped. Its session (if any) ends with it, the client can't resume it
+func (connection *Connection) CloseWithCode(code int, reason string) error {
+	if connection.session != nil {
+		connection.session.end(connection)
+	}
+
+	return connection.base.CloseWithCode(code, reason)
 }
 
 ////
 
-func assignConnection(parent *Server, conn *ws.Conn, r *http.Request, privateMessagePropertyName string, connectionId int) *Connection {
+func assignConnection(parent *Server, conn *ws.Conn, r *http.Request, privateMessagePropertyName string, connectionId string, remoteIP string, principal string) *Connection {
 	var connection Connection
 
-	connection.init(parent, conn, r, privateMessagePropertyName, connectionId)
+	connection.init(parent, conn, r, privateMessagePropertyName, connectionId, remoteIP, principal)
 
 	return &connection
 }
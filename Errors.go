@@ -0,0 +1,12 @@
+package gows
+
+import "github.com/GTedZ/gows/websockets"
+
+// Emitted through 'OnError' when the peer sends a message bigger than the configured 'ReadLimit'
+var ErrReadLimitExceeded = websockets.ErrReadLimitExceeded
+
+// Wrapped by the error returned from 'SendPrivateMessage()' when the connection drops before the response is received, check it with errors.Is()
+var ErrDisconnected = websockets.ErrDisconnected
+
+// Returned when waiting on, or sending through, a client that has been closed
+var ErrSocketClosed = websockets.ErrSocketClosed
@@ -0,0 +1,595 @@
+package gows
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/GTedZ/gows/websockets"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// Size in bytes of the chunks files are split into
+	FILE_TRANSFER_CHUNK_SIZE = 256 * 1024
+	// Amount of unacknowledged chunks the sender may have in flight
+	FILE_TRANSFER_WINDOW = 8
+	// The transfer fails if the receiver doesn't acknowledge anything for this long
+	FILE_TRANSFER_ACK_TIMEOUT_SEC = 30
+	// Incomplete incoming transfers are forgotten (and can no longer be resumed) once idle for this long
+	FILE_TRANSFER_RESUME_TIMEOUT_SEC = 10 * 60
+	// Size in bytes of the biggest chunk frame, the receiver's read limit and stream threshold must be at least this big
+	FILE_TRANSFER_MAX_FRAME_SIZE = 4 + 1 + 1 + 255 + 8 + sha256.Size + FILE_TRANSFER_CHUNK_SIZE
+)
+
+// Wrapped by the error returned from 'SendFile()' when the receiver rejects or aborts the transfer
+var ErrFileTransferFailed = errors.New("file transfer failed")
+
+// Describes a file transfer, passed to the file callbacks
+type FileTransfer struct {
+	TransferId string
+	Name       string
+	Size       int64
+	// Bytes acknowledged by the receiver so far, including the ones transferred before a resume
+	Transferred int64
+	// Whether this side is the one sending the file
+	Sending bool
+}
+
+//// Frames
+
+// Every frame is a binary message starting with the magic, followed by the frame kind
+//
+// Chunks are laid out as: id length (1 byte), id, offset (8 bytes), SHA-256 of the data (32 bytes), data
+//
+// Every other frame carries a JSON 'fileFrameHeader'
+var fileFrameMagic = []byte("GWFT")
+
+const (
+	fileFrame_Offer byte = iota + 1
+	fileFrame_Accept
+	fileFrame_Chunk
+	fileFrame_Ack
+	fileFrame_Error
+
+	// Never sent, emitted locally to the outgoing transfers once the connection drops
+	fileFrame_Disconnected byte = 0
+)
+
+type fileFrameHeader struct {
+	TransferId string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	// Accept: offset to resume from, Ack: next expected offset
+	Offset int64 `json:"offset,omitempty"`
+	// Set on acks asking the sender to resend everything from 'Offset' (checksum mismatch)
+	Retransmit bool   `json:"retransmit,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type fileTransferEvent struct {
+	kind   byte
+	header fileFrameHeader
+}
+
+// Chunks bigger than the read limit close the connection, and the ones bigger than the stream threshold are handed to 'OnMessageStream' instead of the transfer
+func checkFileTransferLimits(readLimit int64, streamThreshold int) {
+	if readLimit > 0 && readLimit < FILE_TRANSFER_MAX_FRAME_SIZE {
+		websockets.Logger.WARN(fmt.Sprintf("The read limit (%d bytes) is smaller than a file transfer chunk (%d bytes), incoming files will fail", readLimit, FILE_TRANSFER_MAX_FRAME_SIZE))
+	}
+	if streamThreshold > 0 && streamThreshold < FILE_TRANSFER_MAX_FRAME_SIZE {
+		websockets.Logger.WARN(fmt.Sprintf("The stream threshold (%d bytes) is smaller than a file transfer chunk (%d bytes), incoming files will fail while 'OnMessageStream' is set", streamThreshold, FILE_TRANSFER_MAX_FRAME_SIZE))
+	}
+}
+
+func newTransferId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+//// Transfers
+
+// Implemented by Client and Connection
+type fileTransferPeer interface {
+	sendFileFrame(frame []byte) error
+	onFileOffer(transfer FileTransfer) (io.WriterAt, error)
+	onFileProgress(transfer FileTransfer)
+	onFileReceived(transfer FileTransfer)
+	onError(err error)
+	// Identifies who uploads are resumed for, a peer only ever sees its owner's incoming transfers
+	fileTransferOwner() string
+	// Blocks until a new connection is established, returns the file transfers to resume through (a server gets the ones of the client's next connection), or an error if the transfer can't be resumed
+	waitForReconnect(ctx context.Context) (*fileTransfers, error)
+}
+
+// Handles the file transfers of a single Client or Connection
+type fileTransfers struct {
+	peer fileTransferPeer
+	// Shared by all the connections of a server, so that uploads can be resumed on a new connection of the same owner
+	incoming *incomingFileTransfers
+
+	outgoing struct {
+		Mu  sync.Mutex
+		Map map[string]*outgoingFileTransfer
+	}
+}
+
+func (files *fileTransfers) init(peer fileTransferPeer, incoming *incomingFileTransfers) {
+	files.peer = peer
+	files.incoming = incoming
+	files.outgoing.Map = make(map[string]*outgoingFileTransfer)
+}
+
+// Returns false if 'msg' isn't a file transfer frame
+func (files *fileTransfers) handleFrame(msg []byte) bool {
+	if len(msg) <= len(fileFrameMagic) || !bytes.HasPrefix(msg, fileFrameMagic) {
+		return false
+	}
+
+	kind := msg[len(fileFrameMagic)]
+	payload := msg[len(fileFrameMagic)+1:]
+
+	if kind == fileFrame_Chunk {
+		files.onChunk(payload)
+		return true
+	}
+
+	var header fileFrameHeader
+	err := jsoniter.Unmarshal(payload, &header)
+	if err != nil {
+		files.peer.onError(fmt.Errorf("invalid file transfer frame: %w", err))
+		return true
+	}
+
+	switch kind {
+	case fileFrame_Offer:
+		files.onOffer(header)
+	case fileFrame_Accept, fileFrame_Ack:
+		files.emit(header.TransferId, fileTransferEvent{kind: kind, header: header})
+	case fileFrame_Error:
+		// Sent by either side, so it may concern a transfer in either direction
+		files.emit(header.TransferId, fileTransferEvent{kind: kind, header: header})
+		files.incoming.remove(files.peer.fileTransferOwner(), header.TransferId)
+	}
+
+	return true
+}
+
+func (files *fileTransfers) sendHeader(kind byte, header fileFrameHeader) error {
+	payload, err := jsoniter.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	frame := append(slices.Clone(fileFrameMagic), kind)
+	return files.peer.sendFileFrame(append(frame, payload...))
+}
+
+// Called once the underlying connection drops
+func (files *fileTransfers) disconnected() {
+	files.outgoing.Mu.Lock()
+	defer files.outgoing.Mu.Unlock()
+
+	for _, outgoing := range files.outgoing.Map {
+		outgoing.emit(fileTransferEvent{kind: fileFrame_Disconnected})
+	}
+}
+
+//// Receiving
+
+type incomingFileTransfers struct {
+	mu        sync.Mutex
+	transfers map[incomingFileKey]*incomingFileTransfer
+}
+
+// Transfer ids are chosen by the sender, so they are only unique per owner
+type incomingFileKey struct {
+	owner      string
+	transferId string
+}
+
+type incomingFileTransfer struct {
+	mu sync.Mutex
+
+	transfer FileTransfer
+	writer   io.WriterAt
+
+	// Set after asking for a retransmission, until the expected chunk arrives
+	awaitingRetransmit bool
+	lastActivity       time.Time
+}
+
+func newIncomingFileTransfers() *incomingFileTransfers {
+	return &incomingFileTransfers{transfers: make(map[incomingFileKey]*incomingFileTransfer)}
+}
+
+func (store *incomingFileTransfers) get(owner string, transferId string) *incomingFileTransfer {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.transfers[incomingFileKey{owner, transferId}]
+}
+
+func (store *incomingFileTransfers) add(owner string, incoming *incomingFileTransfer) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.transfers[incomingFileKey{owner, incoming.transfer.TransferId}] = incoming
+}
+
+func (store *incomingFileTransfers) remove(owner string, transferId string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.transfers, incomingFileKey{owner, transferId})
+}
+
+// Returns the transfer to resume if 'header' matches a known one, forgetting the ones idle for too long
+func (store *incomingFileTransfers) resumable(owner string, header fileFrameHeader) *incomingFileTransfer {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for key, incoming := range store.transfers {
+		incoming.mu.Lock()
+		expired := time.Since(incoming.lastActivity) > FILE_TRANSFER_RESUME_TIMEOUT_SEC*time.Second
+		incoming.mu.Unlock()
+
+		if expired {
+			delete(store.transfers, key)
+		}
+	}
+
+	key := incomingFileKey{owner, header.TransferId}
+	incoming, exists := store.transfers[key]
+	if !exists {
+		return nil
+	}
+
+	// Same id but a different file, start over
+	if incoming.transfer.Name != header.Name || incoming.transfer.Size != header.Size {
+		delete(store.transfers, key)
+		return nil
+	}
+
+	return incoming
+}
+
+func (files *fileTransfers) onOffer(header fileFrameHeader) {
+	owner := files.peer.fileTransferOwner()
+
+	if header.Size < 0 {
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: header.TransferId, Error: "invalid file size"})
+		return
+	}
+
+	incoming := files.incoming.resumable(owner, header)
+	if incoming == nil {
+		transfer := FileTransfer{TransferId: header.TransferId, Name: header.Name, Size: header.Size}
+
+		writer, err := files.peer.onFileOffer(transfer)
+		if err == nil && writer == nil {
+			err = errors.New("file transfers are not accepted")
+		}
+		if err != nil {
+			files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: header.TransferId, Error: err.Error()})
+			return
+		}
+
+		incoming = &incomingFileTransfer{transfer: transfer, writer: writer}
+		files.incoming.add(owner, incoming)
+	}
+
+	incoming.mu.Lock()
+	incoming.awaitingRetransmit = false
+	incoming.lastActivity = time.Now()
+	transfer := incoming.transfer
+	incoming.mu.Unlock()
+
+	files.sendHeader(fileFrame_Accept, fileFrameHeader{TransferId: transfer.TransferId, Offset: transfer.Transferred})
+
+	// Empty files are complete as soon as they are accepted
+	if transfer.Transferred == transfer.Size {
+		files.incoming.remove(owner, transfer.TransferId)
+		files.peer.onFileReceived(transfer)
+	}
+}
+
+func (files *fileTransfers) onChunk(payload []byte) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0])+8+sha256.Size {
+		files.peer.onError(errors.New("invalid file transfer chunk"))
+		return
+	}
+
+	idLength := int(payload[0])
+	transferId := string(payload[1 : 1+idLength])
+	offset := int64(binary.BigEndian.Uint64(payload[1+idLength:]))
+	checksum := payload[1+idLength+8 : 1+idLength+8+sha256.Size]
+	data := payload[1+idLength+8+sha256.Size:]
+
+	owner := files.peer.fileTransferOwner()
+
+	incoming := files.incoming.get(owner, transferId)
+	if incoming == nil {
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transferId, Error: "unknown transfer"})
+		return
+	}
+
+	incoming.mu.Lock()
+	incoming.lastActivity = time.Now()
+
+	// Chunks following a corrupted one are dropped until the retransmission starts
+	if offset != incoming.transfer.Transferred {
+		retransmit := !incoming.awaitingRetransmit
+		incoming.awaitingRetransmit = true
+		expected := incoming.transfer.Transferred
+		incoming.mu.Unlock()
+
+		if retransmit {
+			files.sendHeader(fileFrame_Ack, fileFrameHeader{TransferId: transferId, Offset: expected, Retransmit: true})
+		}
+		return
+	}
+
+	// Never written past the size that was accepted
+	if offset+int64(len(data)) > incoming.transfer.Size {
+		incoming.mu.Unlock()
+
+		files.incoming.remove(owner, transferId)
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transferId, Error: "chunk exceeds the file size"})
+		files.peer.onError(fmt.Errorf("file transfer %s: chunk exceeds the file size", transferId))
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], checksum) {
+		incoming.awaitingRetransmit = true
+		expected := incoming.transfer.Transferred
+		incoming.mu.Unlock()
+
+		files.sendHeader(fileFrame_Ack, fileFrameHeader{TransferId: transferId, Offset: expected, Retransmit: true})
+		return
+	}
+
+	_, err := incoming.writer.WriteAt(data, offset)
+	if err != nil {
+		incoming.mu.Unlock()
+
+		files.incoming.remove(owner, transferId)
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transferId, Error: err.Error()})
+		files.peer.onError(fmt.Errorf("file transfer %s: %w", transferId, err))
+		return
+	}
+
+	incoming.transfer.Transferred += int64(len(data))
+	incoming.awaitingRetransmit = false
+	transfer := incoming.transfer
+	incoming.mu.Unlock()
+
+	files.sendHeader(fileFrame_Ack, fileFrameHeader{TransferId: transferId, Offset: transfer.Transferred})
+	files.peer.onFileProgress(transfer)
+
+	if transfer.Transferred == transfer.Size {
+		files.incoming.remove(owner, transferId)
+		files.peer.onFileReceived(transfer)
+	}
+}
+
+//// Sending
+
+type outgoingFileTransfer struct {
+	// Accepts and acks
+	events chan fileTransferEvent
+	// The error or disconnection ending the current attempt
+	ended chan fileTransferEvent
+}
+
+// Never blocks the read loop
+//
+// The events channel is large enough for a full window of acks, which are cumulative anyway. The first error or disconnection is always kept, the ones following it are redundant
+func (outgoing *outgoingFileTransfer) emit(event fileTransferEvent) {
+	events := outgoing.events
+	if event.kind == fileFrame_Error || event.kind == fileFrame_Disconnected {
+		events = outgoing.ended
+	}
+
+	select {
+	case events <- event:
+	default:
+	}
+}
+
+func (files *fileTransfers) emit(transferId string, event fileTransferEvent) {
+	files.outgoing.Mu.Lock()
+	outgoing, exists := files.outgoing.Map[transferId]
+	files.outgoing.Mu.Unlock()
+
+	if exists {
+		outgoing.emit(event)
+	}
+}
+
+func (files *fileTransfers) sendFile(ctx context.Context, name string, reader io.ReaderAt, size int64, transferId string) error {
+	if len(transferId) == 0 || len(transferId) > 255 {
+		return errors.New("the transfer id must be 1 to 255 bytes long")
+	}
+
+	outgoing := &outgoingFileTransfer{
+		events: make(chan fileTransferEvent, 2*FILE_TRANSFER_WINDOW+2),
+		ended:  make(chan fileTransferEvent, 1),
+	}
+
+	files.outgoing.Mu.Lock()
+	_, exists := files.outgoing.Map[transferId]
+	if !exists {
+		files.outgoing.Map[transferId] = outgoing
+	}
+	files.outgoing.Mu.Unlock()
+	if exists {
+		return fmt.Errorf("file transfer %s is already in progress", transferId)
+	}
+
+	// 'files' changes when the transfer is resumed on another connection
+	defer func() {
+		files.outgoing.Mu.Lock()
+		delete(files.outgoing.Map, transferId)
+		files.outgoing.Mu.Unlock()
+	}()
+
+	transfer := FileTransfer{TransferId: transferId, Name: name, Size: size, Sending: true}
+	for {
+		err := files.transmit(ctx, outgoing, &transfer, reader)
+		if !errors.Is(err, ErrDisconnected) {
+			return err
+		}
+
+		// Resumes from the receiver's offset once reconnected
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+		next, waitErr := files.peer.waitForReconnect(ctx)
+		if waitErr != nil {
+			return err
+		}
+		if next != files {
+			err = files.moveOutgoing(next, transferId, outgoing)
+			if err != nil {
+				return err
+			}
+			files = next
+		}
+
+		for len(outgoing.events) > 0 {
+			<-outgoing.events
+		}
+		for len(outgoing.ended) > 0 {
+			<-outgoing.ended
+		}
+	}
+}
+
+// Hands 'outgoing' over to 'next', so that the frames of the client's new connection reach it
+func (files *fileTransfers) moveOutgoing(next *fileTransfers, transferId string, outgoing *outgoingFileTransfer) error {
+	next.outgoing.Mu.Lock()
+	_, exists := next.outgoing.Map[transferId]
+	if !exists {
+		next.outgoing.Map[transferId] = outgoing
+	}
+	next.outgoing.Mu.Unlock()
+	if exists {
+		return fmt.Errorf("file transfer %s is already in progress", transferId)
+	}
+
+	files.outgoing.Mu.Lock()
+	delete(files.outgoing.Map, transferId)
+	files.outgoing.Mu.Unlock()
+
+	return nil
+}
+
+// Offers the file and sends it from the offset accepted by the receiver, returns an error wrapping ErrDisconnected if the connection drops
+func (files *fileTransfers) transmit(ctx context.Context, outgoing *outgoingFileTransfer, transfer *FileTransfer, reader io.ReaderAt) error {
+	err := files.sendHeader(fileFrame_Offer, fileFrameHeader{TransferId: transfer.TransferId, Name: transfer.Name, Size: transfer.Size})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDisconnected, err)
+	}
+
+	event, err := files.waitForEvent(ctx, outgoing, transfer)
+	if err != nil {
+		return err
+	}
+	if event.kind != fileFrame_Accept {
+		return fmt.Errorf("%w: unexpected frame before the offer was accepted", ErrFileTransferFailed)
+	}
+
+	transfer.Transferred = event.header.Offset
+	next := transfer.Transferred
+
+	frame := make([]byte, 0, len(fileFrameMagic)+1+1+len(transfer.TransferId)+8+sha256.Size+FILE_TRANSFER_CHUNK_SIZE)
+	chunk := make([]byte, FILE_TRANSFER_CHUNK_SIZE)
+	for transfer.Transferred < transfer.Size {
+		for next < transfer.Size && next-transfer.Transferred < FILE_TRANSFER_WINDOW*FILE_TRANSFER_CHUNK_SIZE {
+			length := min(int64(FILE_TRANSFER_CHUNK_SIZE), transfer.Size-next)
+
+			n, err := reader.ReadAt(chunk[:length], next)
+			if int64(n) < length {
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transfer.TransferId, Error: "the sender failed to read the file"})
+				return err
+			}
+
+			sum := sha256.Sum256(chunk[:length])
+
+			frame = append(frame[:0], fileFrameMagic...)
+			frame = append(frame, fileFrame_Chunk, byte(len(transfer.TransferId)))
+			frame = append(frame, transfer.TransferId...)
+			frame = binary.BigEndian.AppendUint64(frame, uint64(next))
+			frame = append(frame, sum[:]...)
+			frame = append(frame, chunk[:length]...)
+
+			err = files.peer.sendFileFrame(frame)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrDisconnected, err)
+			}
+
+			next += length
+		}
+
+		event, err := files.waitForEvent(ctx, outgoing, transfer)
+		if err != nil {
+			return err
+		}
+		if event.kind != fileFrame_Ack {
+			continue
+		}
+
+		if event.header.Offset > transfer.Transferred {
+			transfer.Transferred = event.header.Offset
+			files.peer.onFileProgress(*transfer)
+		}
+		if event.header.Retransmit && event.header.Offset < next {
+			next = event.header.Offset
+		}
+	}
+
+	return nil
+}
+
+// Returns the next accept or ack, or the error that ended the transfer
+func (files *fileTransfers) waitForEvent(ctx context.Context, outgoing *outgoingFileTransfer, transfer *FileTransfer) (fileTransferEvent, error) {
+	timeout := time.NewTimer(FILE_TRANSFER_ACK_TIMEOUT_SEC * time.Second)
+	defer timeout.Stop()
+
+	select {
+	case <-ctx.Done():
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transfer.TransferId, Error: "cancelled by the sender"})
+		return fileTransferEvent{}, ctx.Err()
+
+	case <-timeout.C:
+		files.sendHeader(fileFrame_Error, fileFrameHeader{TransferId: transfer.TransferId, Error: "acknowledgement timeout"})
+		return fileTransferEvent{}, fmt.Errorf("%w: no acknowledgement received for %d seconds", ErrFileTransferFailed, FILE_TRANSFER_ACK_TIMEOUT_SEC)
+
+	case event := <-outgoing.ended:
+		if event.kind == fileFrame_Disconnected {
+			return event, ErrDisconnected
+		}
+		return event, fmt.Errorf("%w: %s", ErrFileTransferFailed, event.header.Error)
+
+	case event := <-outgoing.events:
+		return event, nil
+	}
+}
@@ -0,0 +1,164 @@
+package gows
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/GTedZ/gows/parser"
+)
+
+// In-memory destination of a received file
+type memoryWriterAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (writer *memoryWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if end := int(offset) + len(p); end > len(writer.data) {
+		writer.data = append(writer.data, make([]byte, end-len(writer.data))...)
+	}
+	copy(writer.data[offset:], p)
+
+	return len(p), nil
+}
+
+func (writer *memoryWriterAt) bytes() []byte {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	return bytes.Clone(writer.data)
+}
+
+// Registers a binary parser accepting any payload, which must never see the protocol frames
+func registerCatchAllParser(registry *parser.MessageParsers_Registry, swallowed chan<- []byte) {
+	parser.RegisterBinaryMessageParserCallback(registry, func(msg []byte) (bool, *[]byte) {
+		return true, &msg
+	}, func(msg *[]byte) {
+		swallowed <- *msg
+	})
+}
+
+func TestFileTransferSkipsParsers(t *testing.T) {
+	server, proxy, _ := newTestServer(t, Server_Params{})
+
+	swallowed := make(chan []byte, 64)
+	uploaded := &memoryWriterAt{}
+	received := make(chan FileTransfer, 1)
+	connections := make(chan *Connection, 1)
+	server.OnConnect = func(connection *Connection) {
+		registerCatchAllParser(connection.GetParserRegistry(), swallowed)
+		connection.OnFileOffer = func(transfer FileTransfer) (io.WriterAt, error) { return uploaded, nil }
+		connection.OnFileReceived = func(transfer FileTransfer) { received <- transfer }
+		connections <- connection
+	}
+
+	client := dialTestClient(t, proxy)
+	registerCatchAllParser(client.GetParserRegistry(), swallowed)
+	receive(t, connections)
+
+	data := make([]byte, 3*FILE_TRANSFER_CHUNK_SIZE+123)
+	rand.Read(data)
+
+	err := client.SendFile(context.Background(), "data.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := receive(t, received)
+	if transfer.Name != "data.bin" || !bytes.Equal(uploaded.bytes(), data) {
+		t.Fatalf("expected the file to be received whole, got %+v", transfer)
+	}
+
+	// Other binary messages still reach the parsers
+	client.SendBinary([]byte("plain"))
+	if msg := receive(t, swallowed); string(msg) != "plain" {
+		t.Fatalf("expected only the plain message to be parsed, got %q", msg)
+	}
+}
+
+// Sends a file big enough to be interrupted, 'send' drops the connection once the receiver has acknowledged a first chunk
+func interruptedFileTransfer(t *testing.T, proxy *testProxy) (data []byte, onProgress func(transfer FileTransfer)) {
+	data = make([]byte, 40*FILE_TRANSFER_CHUNK_SIZE)
+	rand.Read(data)
+
+	var once sync.Once
+	return data, func(transfer FileTransfer) {
+		if !transfer.Sending && transfer.Transferred > 0 {
+			once.Do(func() { proxy.drop(false) })
+		}
+	}
+}
+
+func TestFileTransferResumesUpload(t *testing.T) {
+	server, proxy, _ := newTestServer(t, Server_Params{})
+	data, onProgress := interruptedFileTransfer(t, proxy)
+
+	// Without a principal nor a session, the client's stream id still lets it resume
+	uploaded := &memoryWriterAt{}
+	offers := make(chan FileTransfer, 16)
+	received := make(chan FileTransfer, 1)
+	server.OnConnect = func(connection *Connection) {
+		connection.OnFileOffer = func(transfer FileTransfer) (io.WriterAt, error) {
+			offers <- transfer
+			return uploaded, nil
+		}
+		connection.OnFileProgress = onProgress
+		connection.OnFileReceived = func(transfer FileTransfer) { received <- transfer }
+	}
+
+	client := dialTestClient(t, proxy)
+	err := client.SendFile(context.Background(), "data.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, received)
+	if !bytes.Equal(uploaded.bytes(), data) {
+		t.Fatal("expected the file to be received whole")
+	}
+	if len(offers) != 1 {
+		t.Fatalf("expected the upload to be resumed rather than offered again, got %d offers", len(offers))
+	}
+}
+
+func TestFileTransferResumesDownload(t *testing.T) {
+	server, proxy, _ := newTestServer(t, Server_Params{})
+	data, onProgress := interruptedFileTransfer(t, proxy)
+
+	connections := make(chan *Connection, 16)
+	server.OnConnect = func(connection *Connection) { connections <- connection }
+
+	downloaded := &memoryWriterAt{}
+	offers := make(chan FileTransfer, 16)
+	received := make(chan FileTransfer, 1)
+	client := dialTestClient(t, proxy)
+	client.OnFileOffer = func(transfer FileTransfer) (io.WriterAt, error) {
+		offers <- transfer
+		return downloaded, nil
+	}
+	client.OnFileProgress = onProgress
+	client.OnFileReceived = func(transfer FileTransfer) { received <- transfer }
+	connection := receive(t, connections)
+
+	// Continued on the client's next connection
+	err := connection.SendFile(context.Background(), "data.bin", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, received)
+	if !bytes.Equal(downloaded.bytes(), data) {
+		t.Fatal("expected the file to be received whole")
+	}
+	if len(offers) != 1 {
+		t.Fatalf("expected the download to be resumed rather than offered again, got %d offers", len(offers))
+	}
+	receive(t, connections)
+}
@@ -0,0 +1,186 @@
+package gows
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Generates the ids of new connections, see 'Server_Params.IDGenerator'
+//
+// NOTE: Must be safe for concurrent use, connections are accepted concurrently
+type IDGenerator interface {
+	NewID() string
+}
+
+//// UUIDv7
+
+// Generates time-ordered UUIDv7s (RFC 9562), e.g. "01890a5d-ac96-774b-bcce-b302099a8057"
+//
+// Ids generated within the same millisecond are kept in order through a 12-bit counter
+type UUIDv7Generator struct {
+	mu       sync.Mutex
+	lastMs   int64
+	sequence uint16
+}
+
+func NewUUIDv7Generator() *UUIDv7Generator {
+	return &UUIDv7Generator{}
+}
+
+func (generator *UUIDv7Generator) NewID() string {
+	var id [16]byte
+	rand.Read(id[:])
+
+	generator.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms > generator.lastMs {
+		generator.lastMs = ms
+		generator.sequence = binary.BigEndian.Uint16(id[6:8]) & 0x07FF // Leaves room for the counter to grow
+	} else {
+		generator.sequence++
+		if generator.sequence > 0x0FFF {
+			// Counter exhausted, borrows the next millisecond
+			generator.lastMs++
+			generator.sequence = 0
+		}
+	}
+	ms = generator.lastMs
+	sequence := generator.sequence
+	generator.mu.Unlock()
+
+	id[0] = byte(ms >> 40)
+	id[1] = byte(ms >> 32)
+	id[2] = byte(ms >> 24)
+	id[3] = byte(ms >> 16)
+	id[4] = byte(ms >> 8)
+	id[5] = byte(ms)
+	id[6] = 0x70 | byte(sequence>>8) // Version 7
+	id[7] = byte(sequence)
+	id[8] = 0x80 | (id[8] & 0x3F) // Variant 10
+
+	encoded := hex.EncodeToString(id[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", encoded[0:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:32])
+}
+
+//// ULID
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generates monotonic ULIDs, e.g. "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+//
+// Ids generated within the same millisecond increment the random part of the previous one
+type ULIDGenerator struct {
+	mu     sync.Mutex
+	lastMs int64
+	random [10]byte
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{}
+}
+
+func (generator *ULIDGenerator) NewID() string {
+	var id [16]byte
+
+	generator.mu.Lock()
+	ms := time.Now().UnixMilli()
+	if ms > generator.lastMs {
+		generator.lastMs = ms
+		rand.Read(generator.random[:])
+	} else {
+		// Increments the 80-bit random part, carrying over
+		for i := len(generator.random) - 1; i >= 0; i-- {
+			generator.random[i]++
+			if generator.random[i] != 0 {
+				break
+			}
+		}
+	}
+	ms = generator.lastMs
+	copy(id[6:], generator.random[:])
+	generator.mu.Unlock()
+
+	id[0] = byte(ms >> 40)
+	id[1] = byte(ms >> 32)
+	id[2] = byte(ms >> 24)
+	id[3] = byte(ms >> 16)
+	id[4] = byte(ms >> 8)
+	id[5] = byte(ms)
+
+	// 128 bits as 26 base32 characters, the first one only holding 3 bits
+	high := binary.BigEndian.Uint64(id[0:8])
+	low := binary.BigEndian.Uint64(id[8:16])
+
+	var encoded [26]byte
+	for i := 25; i >= 0; i-- {
+		encoded[i] = crockfordBase32[low&0x1F]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+
+	return string(encoded[:])
+}
+
+//// Snowflake
+
+// Epoch of the snowflake timestamps (2024-01-01T00:00:00Z), in Unix milliseconds
+const SNOWFLAKE_EPOCH_MS = 1704067200000
+
+// Largest node id a snowflake can hold (10 bits)
+const SNOWFLAKE_MAX_NODE = 1023
+
+// Generates decimal snowflake ids: 41 bits of milliseconds since SNOWFLAKE_EPOCH_MS, 10 bits of node id and a 12-bit sequence
+//
+// Give every server instance a distinct node id and ids never collide across instances
+type SnowflakeGenerator struct {
+	node int64
+
+	mu       sync.Mutex
+	lastMs   int64
+	sequence int64
+}
+
+// 'node' must be between 0 and SNOWFLAKE_MAX_NODE
+func NewSnowflakeGenerator(node int64) (*SnowflakeGenerator, error) {
+	if node < 0 || node > SNOWFLAKE_MAX_NODE {
+		return nil, fmt.Errorf("snowflake node id must be between 0 and %d, got %d", SNOWFLAKE_MAX_NODE, node)
+	}
+
+	return &SnowflakeGenerator{node: node}, nil
+}
+
+func (generator *SnowflakeGenerator) NewID() string {
+	generator.mu.Lock()
+	defer generator.mu.Unlock()
+
+	ms := time.Now().UnixMilli() - SNOWFLAKE_EPOCH_MS
+	if ms > generator.lastMs {
+		generator.lastMs = ms
+		generator.sequence = 0
+	} else {
+		// Same millisecond (or the clock went backwards), keeps counting from the last one
+		generator.sequence++
+		if generator.sequence > 0x0FFF {
+			generator.lastMs++
+			generator.sequence = 0
+		}
+	}
+
+	id := generator.lastMs<<22 | generator.node<<12 | generator.sequence
+	return strconv.FormatInt(id, 10)
+}
+
+// Returns the node id a snowflake was generated by, useful to route a connection id to the server instance holding it
+func SnowflakeNode(id string) (node int64, err error) {
+	value, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return (value >> 12) & SNOWFLAKE_MAX_NODE, nil
+}
@@ -0,0 +1,234 @@
+package gows
+
+import (
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	uuidv7Format = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidFormat   = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+func newTestSnowflakeGenerator(t *testing.T, node int64) *SnowflakeGenerator {
+	t.Helper()
+
+	generator, err := NewSnowflakeGenerator(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return generator
+}
+
+// Snowflakes are decimal, so they only sort as numbers
+func snowflakeLess(a, b string) bool {
+	x, _ := strconv.ParseInt(a, 10, 64)
+	y, _ := strconv.ParseInt(b, 10, 64)
+	return x < y
+}
+
+func stringLess(a, b string) bool {
+	return a < b
+}
+
+//// Format
+
+func TestUUIDv7Format(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewUUIDv7Generator().NewID()
+	after := time.Now().UnixMilli()
+
+	if !uuidv7Format.MatchString(id) {
+		t.Fatalf("expected a UUIDv7 with its version and variant bits, got %q", id)
+	}
+
+	// The first 48 bits are the Unix milliseconds
+	raw, _ := hex.DecodeString(strings.ReplaceAll(id, "-", "")[:12])
+	var ms int64
+	for _, b := range raw {
+		ms = ms<<8 | int64(b)
+	}
+	if ms < before || ms > after {
+		t.Fatalf("expected a timestamp between %d and %d, got %d", before, after, ms)
+	}
+}
+
+func TestULIDFormat(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewULIDGenerator().NewID()
+	after := time.Now().UnixMilli()
+
+	if !ulidFormat.MatchString(id) {
+		t.Fatalf("expected a Crockford base32 ULID, got %q", id)
+	}
+
+	// The first 10 characters are the Unix milliseconds
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockfordBase32, c))
+	}
+	if ms < before || ms > after {
+		t.Fatalf("expected a timestamp between %d and %d, got %d", before, after, ms)
+	}
+}
+
+func TestSnowflakeFormat(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := newTestSnowflakeGenerator(t, 42).NewID()
+	after := time.Now().UnixMilli()
+
+	value, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		t.Fatalf("expected a decimal id, got %q", id)
+	}
+	if ms := value>>22 + SNOWFLAKE_EPOCH_MS; ms < before || ms > after {
+		t.Fatalf("expected a timestamp between %d and %d, got %d", before, after, ms)
+	}
+	if node, _ := SnowflakeNode(id); node != 42 {
+		t.Fatalf("expected node 42, got %d", node)
+	}
+
+	for _, node := range []int64{-1, SNOWFLAKE_MAX_NODE + 1} {
+		if _, err := NewSnowflakeGenerator(node); err == nil {
+			t.Fatalf("expected node %d to be rejected", node)
+		}
+	}
+}
+
+//// Ordering
+
+func TestIDsMonotonicWithinMillisecond(t *testing.T) {
+	// Every id is generated within the same (future) millisecond, so that the order only comes from the counters
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	uuid := NewUUIDv7Generator()
+	uuid.lastMs = future
+
+	ulid := NewULIDGenerator()
+	ulid.lastMs = future
+
+	snowflake := newTestSnowflakeGenerator(t, 1)
+	snowflake.lastMs = future - SNOWFLAKE_EPOCH_MS
+
+	tests := []struct {
+		name      string
+		generator IDGenerator
+		less      func(a, b string) bool
+	}{
+		{name: "uuidv7", generator: uuid, less: stringLess},
+		{name: "ulid", generator: ulid, less: stringLess},
+		{name: "snowflake", generator: snowflake, less: snowflakeLess},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := test.generator.NewID()
+			// More than a 12-bit counter holds, so that the counters roll over at least once
+			for range 10000 {
+				id := test.generator.NewID()
+				if !test.less(previous, id) {
+					t.Fatalf("expected %q to sort after %q", id, previous)
+				}
+				previous = id
+			}
+		})
+	}
+}
+
+func TestUUIDv7CounterRollover(t *testing.T) {
+	generator := NewUUIDv7Generator()
+	future := time.Now().Add(time.Hour).UnixMilli()
+	generator.lastMs = future
+	generator.sequence = 0x0FFE
+
+	last := generator.NewID()
+	next := generator.NewID()
+
+	if generator.lastMs != future+1 || generator.sequence != 0 {
+		t.Fatalf("expected the counter to borrow the next millisecond, got %d (sequence %d)", generator.lastMs-future, generator.sequence)
+	}
+	if !uuidv7Format.MatchString(next) || next <= last {
+		t.Fatalf("expected %q to be a UUIDv7 sorting after %q", next, last)
+	}
+}
+
+func TestULIDRandomCarry(t *testing.T) {
+	generator := NewULIDGenerator()
+	generator.lastMs = time.Now().Add(time.Hour).UnixMilli()
+	generator.random = [10]byte{0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF}
+
+	generator.NewID()
+	if generator.random != [10]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0} {
+		t.Fatalf("expected the increment to carry over, got %x", generator.random)
+	}
+}
+
+func TestSnowflakeSequenceRollover(t *testing.T) {
+	generator := newTestSnowflakeGenerator(t, 7)
+	future := time.Now().Add(time.Hour).UnixMilli() - SNOWFLAKE_EPOCH_MS
+	generator.lastMs = future
+	generator.sequence = 0x0FFE
+
+	last := generator.NewID()
+	next := generator.NewID()
+
+	value, _ := strconv.ParseInt(next, 10, 64)
+	if ms, sequence := value>>22, value&0x0FFF; ms != future+1 || sequence != 0 {
+		t.Fatalf("expected the sequence to roll over into the next millisecond, got %d (sequence %d)", ms-future, sequence)
+	}
+	if !snowflakeLess(last, next) {
+		t.Fatalf("expected %q to sort after %q", next, last)
+	}
+	if node, _ := SnowflakeNode(next); node != 7 {
+		t.Fatalf("expected the node to be kept, got %d", node)
+	}
+}
+
+//// Uniqueness
+
+func TestIDsUniqueUnderConcurrency(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator IDGenerator
+	}{
+		{name: "uuidv7", generator: NewUUIDv7Generator()},
+		{name: "ulid", generator: NewULIDGenerator()},
+		{name: "snowflake", generator: newTestSnowflakeGenerator(t, 0)},
+	}
+
+	const goroutines, perGoroutine = 8, 5000
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids := make([][]string, goroutines)
+
+			var wg sync.WaitGroup
+			for i := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range perGoroutine {
+						ids[i] = append(ids[i], test.generator.NewID())
+					}
+				}()
+			}
+			wg.Wait()
+
+			seen := make(map[string]struct{}, goroutines*perGoroutine)
+			for _, generated := range ids {
+				for _, id := range generated {
+					if _, duplicate := seen[id]; duplicate {
+						t.Fatalf("expected unique ids, got %q twice", id)
+					}
+					seen[id] = struct{}{}
+				}
+			}
+		})
+	}
+}
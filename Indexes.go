@@ -0,0 +1,189 @@
+package gows
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// Secondary indexes over the connections' data, see 'Server.IndexBy()'
+//
+// Locked after the connection's data whenever both are needed
+type connectionIndexes struct {
+	mu      sync.RWMutex
+	indexes map[string]*connectionIndex
+}
+
+type connectionIndex struct {
+	// Value -> connections holding it
+	connections map[interface{}]map[*Connection]struct{}
+	// Connection -> values currently indexed for it
+	values map[*Connection][]interface{}
+}
+
+func (indexes *connectionIndexes) init() {
+	indexes.indexes = make(map[string]*connectionIndex)
+}
+
+// Only comparable values can be used as map keys
+func isIndexable(value interface{}) bool {
+	return value != nil && reflect.TypeOf(value).Comparable()
+}
+
+// Replaces the values indexed for 'connection', so that re-indexing the same values is a no-op
+func (index *connectionIndex) set(connection *Connection, values []interface{}) {
+	for _, value := range index.values[connection] {
+		delete(index.connections[value], connection)
+		if len(index.connections[value]) == 0 {
+			delete(index.connections, value)
+		}
+	}
+	delete(index.values, connection)
+
+	for _, value := range values {
+		if !isIndexable(value) {
+			continue
+		}
+
+		connections, exists := index.connections[value]
+		if !exists {
+			connections = make(map[*Connection]struct{})
+			index.connections[value] = connections
+		}
+		connections[connection] = struct{}{}
+		index.values[connection] = append(index.values[connection], value)
+	}
+}
+
+// Re-indexes the values 'connection' holds under 'key', called with the connection's data locked
+func (indexes *connectionIndexes) update(connection *Connection, key string) {
+	indexes.mu.Lock()
+	defer indexes.mu.Unlock()
+
+	index, indexed := indexes.indexes[key]
+	if !indexed {
+		return
+	}
+
+	index.set(connection, connection.Data.valuesOf(key))
+}
+
+// Starts tracking the data changes of 'connection', indexing the values it already holds
+func (indexes *connectionIndexes) addConnection(connection *Connection) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	data.onChange = func(key string) {
+		indexes.update(connection, key)
+	}
+
+	indexes.mu.Lock()
+	defer indexes.mu.Unlock()
+
+	for key, index := range indexes.indexes {
+		index.set(connection, data.valuesOf(key))
+	}
+}
+
+// Removes 'connection' from every index, its later data changes are no longer tracked
+func (indexes *connectionIndexes) removeConnection(connection *Connection) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	data.onChange = nil
+
+	indexes.mu.Lock()
+	defer indexes.mu.Unlock()
+
+	for _, index := range indexes.indexes {
+		index.set(connection, nil)
+	}
+}
+
+// Indexes the values 'connection' currently holds under 'key', unless it has been removed meanwhile
+func (indexes *connectionIndexes) backfill(connection *Connection, key string) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	if data.onChange == nil {
+		return
+	}
+
+	indexes.update(connection, key)
+}
+
+func (indexes *connectionIndexes) lookup(key string, value interface{}) (connections []*Connection, indexed bool) {
+	indexes.mu.RLock()
+	defer indexes.mu.RUnlock()
+
+	index, indexed := indexes.indexes[key]
+	if !indexed {
+		return nil, false
+	}
+
+	if isIndexable(value) {
+		for connection := range index.connections[value] {
+			connections = append(connections, connection)
+		}
+	}
+
+	return connections, true
+}
+
+//// Server methods
+
+// Indexes the connections by the value they store under 'key' (through any of the 'Data' setters, or a 'Key[T]' of that name), turning 'ConnectionsFor(key, ...)' into a lookup instead of a scan
+//
+// The current connections are indexed right away, and the index then follows every data change and disconnection. Values that aren't comparable (slices, maps...) are never indexed
+func (server *Server) IndexBy(key string) {
+	server.indexes.mu.Lock()
+	_, exists := server.indexes.indexes[key]
+	if !exists {
+		server.indexes.indexes[key] = &connectionIndex{
+			connections: make(map[interface{}]map[*Connection]struct{}),
+			values:      make(map[*Connection][]interface{}),
+		}
+	}
+	server.indexes.mu.Unlock()
+
+	if exists {
+		return
+	}
+
+	// Changes made meanwhile are already tracked by the hooks, and re-indexing a connection is a no-op
+	for _, connection := range server.Connections.snapshot() {
+		server.indexes.backfill(connection, key)
+	}
+}
+
+// Returns the connections for which 'predicate' returns true
+func (server *Server) Find(predicate func(connection *Connection) bool) []*Connection {
+	return slices.DeleteFunc(server.Connections.snapshot(), func(connection *Connection) bool {
+		return !predicate(connection)
+	})
+}
+
+// Returns the connections storing 'value' under 'key', 'value' must be of the type it was stored as (e.g. int64 for 'SetInt()')
+//
+// Every connection is scanned unless 'key' is indexed, see 'IndexBy()'
+func (server *Server) ConnectionsFor(key string, value interface{}) []*Connection {
+	connections, indexed := server.indexes.lookup(key, value)
+	if indexed {
+		return connections
+	}
+
+	return server.Find(func(connection *Connection) bool {
+		connection.Data.mu.Lock()
+		defer connection.Data.mu.Unlock()
+
+		for _, stored := range connection.Data.valuesOf(key) {
+			if isIndexable(stored) && stored == value {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,97 @@
+package gows
+
+// Type-safe key of the per-connection data store, declared once and used with any connection
+//
+//	var SessionKey = gows.NewKey[*Session]("session")
+//
+//	SessionKey.Set(conn, &Session{UserId: 42})
+//	session, exists := SessionKey.Get(conn)
+type Key[T any] struct {
+	name string
+}
+
+// Implemented by every Key[T], used to name the values when iterating
+type namedKey interface {
+	Name() string
+}
+
+// 'name' is only used to identify the value in 'Data.Range()' and 'Data.Snapshot()', so keep it unique
+//
+// NOTE: Keys of different types never collide, even with the same name
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+func (key Key[T]) Name() string {
+	return key.name
+}
+
+func (key Key[T]) Get(connection *Connection) (value T, exists bool) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	stored, exists := data.keys[key]
+	if !exists {
+		return value, false
+	}
+
+	return stored.(T), true
+}
+
+func (key Key[T]) Set(connection *Connection, value T) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	data.keys[key] = value
+	data.notify(key.name)
+}
+
+func (key Key[T]) Delete(connection *Connection) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	delete(data.keys, key)
+	data.notify(key.name)
+}
+
+// Sets the value to 'new' only if it is currently set to 'old', returns whether it was swapped
+//
+// NOTE: Panics if T is not comparable, like sync.Map's CompareAndSwap
+func (key Key[T]) CompareAndSwap(connection *Connection, old T, new T) (swapped bool) {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	stored, exists := data.keys[key]
+	if !exists || stored != any(old) {
+		return false
+	}
+
+	data.keys[key] = new
+	data.notify(key.name)
+	return true
+}
+
+// Atomically replaces the value with the one returned by 'update', which receives the current value (the zero value if it doesn't exist), and returns the new value
+//
+// WARNING: The connection's data is locked while 'update' runs, it must not access the connection's data itself
+func (key Key[T]) Update(connection *Connection, update func(value T, exists bool) T) T {
+	data := &connection.Data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	var value T
+	stored, exists := data.keys[key]
+	if exists {
+		value = stored.(T)
+	}
+
+	value = update(value, exists)
+	data.keys[key] = value
+	data.notify(key.name)
+
+	return value
+}
@@ -0,0 +1,142 @@
+package gows
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type RejectReason int
+
+const (
+	RejectReason_TooManyConnections RejectReason = iota + 1
+	RejectReason_TooManyConnectionsPerIP
+	RejectReason_TooManyConnectionsPerPrincipal
+)
+
+func (reason RejectReason) String() string {
+	switch reason {
+	case RejectReason_TooManyConnections:
+		return "too many connections"
+	case RejectReason_TooManyConnectionsPerIP:
+		return "too many connections for this IP"
+	case RejectReason_TooManyConnectionsPerPrincipal:
+		return "too many connections for this principal"
+	}
+
+	return "unknown"
+}
+
+// The HTTP status the upgrade request is rejected with
+func (reason RejectReason) statusCode() int {
+	if reason == RejectReason_TooManyConnections {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusTooManyRequests
+}
+
+//// Connection Limiter
+
+// Keeps track of the active connections per IP and per principal
+//
+// Slots are acquired before upgrading, so that concurrent upgrades can never exceed the limits
+type connectionLimiter struct {
+	mu sync.Mutex
+
+	maxTotal        int
+	maxPerIP        int
+	maxPerPrincipal int
+
+	total        int
+	perIP        map[string]int
+	perPrincipal map[string]int
+}
+
+func (limiter *connectionLimiter) init(maxTotal int, maxPerIP int, maxPerPrincipal int) {
+	limiter.maxTotal = maxTotal
+	limiter.maxPerIP = maxPerIP
+	limiter.maxPerPrincipal = maxPerPrincipal
+
+	limiter.perIP = make(map[string]int)
+	limiter.perPrincipal = make(map[string]int)
+}
+
+func (limiter *connectionLimiter) acquire(ip string, principal string) (ok bool, reason RejectReason) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.maxTotal > 0 && limiter.total >= limiter.maxTotal {
+		return false, RejectReason_TooManyConnections
+	}
+	if limiter.maxPerIP > 0 && limiter.perIP[ip] >= limiter.maxPerIP {
+		return false, RejectReason_TooManyConnectionsPerIP
+	}
+	if principal != "" && limiter.maxPerPrincipal > 0 && limiter.perPrincipal[principal] >= limiter.maxPerPrincipal {
+		return false, RejectReason_TooManyConnectionsPerPrincipal
+	}
+
+	limiter.total++
+	limiter.perIP[ip]++
+	if principal != "" {
+		limiter.perPrincipal[principal]++
+	}
+
+	return true, 0
+}
+
+func (limiter *connectionLimiter) release(ip string, principal string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.total--
+
+	limiter.perIP[ip]--
+	if limiter.perIP[ip] <= 0 {
+		delete(limiter.perIP, ip)
+	}
+
+	if principal != "" {
+		limiter.perPrincipal[principal]--
+		if limiter.perPrincipal[principal] <= 0 {
+			delete(limiter.perPrincipal, principal)
+		}
+	}
+}
+
+//// Remote IP resolution
+
+// Returns the client's IP, honoring the trusted proxy headers in order
+//
+// For list headers such as "X-Forwarded-For", every proxy appends the address it received the request from, so the client's IP is the entry 'trustedHops' from the right (the left-most entries are whatever the client sent)
+func resolveRemoteIP(r *http.Request, trustedProxyHeaders []string, trustedHops int) string {
+	if trustedHops <= 0 {
+		trustedHops = 1
+	}
+
+	for _, header := range trustedProxyHeaders {
+		values := r.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		// Repeated headers are one list, in order
+		hops := strings.Split(strings.Join(values, ","), ",")
+		if len(hops) < trustedHops {
+			continue
+		}
+
+		hop := strings.TrimSpace(hops[len(hops)-trustedHops])
+		if hop != "" {
+			return hop
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
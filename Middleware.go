@@ -0,0 +1,163 @@
+package gows
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/GTedZ/gows/websockets"
+	ws "github.com/gorilla/websocket"
+)
+
+// An inbound message going through the middleware chain, see 'Server.Use()'
+type Message struct {
+	Connection *Connection
+	// websocket.TextMessage or websocket.BinaryMessage
+	Type int
+	// Must not be modified in place, nor kept after the chain returns
+	//
+	// A middleware may replace it (e.g. once decrypted), the data passed to 'next' is the one processed. nil for a streamed message (see 'Connection.OnMessageStream')
+	//
+	// Reliable messages and file offers come as their binary protocol frames, see 'interceptMessage()'
+	Data []byte
+	// Set instead of 'Data' for a streamed message, only valid until the chain returns
+	//
+	// A middleware may wrap or replace it, the reader passed to 'next' is the one handed to 'OnMessageStream'
+	Reader io.Reader
+
+	// Processes 'Data' further: parsers, then 'OnRequest' or 'OnMessage'
+	dispatch func(data []byte)
+
+	requestChecked bool
+	requestId      string
+	isRequest      bool
+}
+
+// Returns the message's request id if it is a private request (see 'Connection.OnRequest')
+//
+// The message is only parsed once, on the first call, replacing 'Data' afterwards isn't reflected. Streamed messages are never requests
+func (message *Message) Request() (requestId string, isRequest bool) {
+	if !message.requestChecked {
+		message.requestId, message.isRequest = websockets.CheckMessageTypeIsPrivate(message.Type, message.Data, message.Connection.parent.privateMessagePropertyName)
+		message.requestChecked = true
+	}
+
+	return message.requestId, message.isRequest
+}
+
+// Processes an inbound message, a middleware calls 'next' to let it through, or returns without calling it to drop it
+type Handler func(message *Message)
+
+func dispatchMessage(message *Message) {
+	message.dispatch(message.Data)
+}
+
+// The middlewares added through 'Server.Use()', composed into a single handler
+type middlewareChain struct {
+	mu          sync.RWMutex
+	middlewares []func(next Handler) Handler
+	handler     Handler
+}
+
+func (chain *middlewareChain) init() {
+	chain.handler = dispatchMessage
+}
+
+func (chain *middlewareChain) use(middlewares ...func(next Handler) Handler) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	chain.middlewares = append(chain.middlewares, middlewares...)
+
+	// The first middleware added is the outermost one
+	handler := Handler(dispatchMessage)
+	for i := len(chain.middlewares) - 1; i >= 0; i-- {
+		handler = chain.middlewares[i](handler)
+	}
+	chain.handler = handler
+}
+
+func (chain *middlewareChain) get() Handler {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
+
+	return chain.handler
+}
+
+//// Connection hooks
+
+// Set as the base socket's interceptor, runs before parsers and callbacks
+//
+// The rate limits apply to every message. Reliable messages and file offers go through the middlewares like any other message (so they can be dropped, leaving them unacknowledged), while the rest of their protocols' frames skip them
+func (connection *Connection) interceptMessage(messageType int, msg []byte, dispatch func(msg []byte)) {
+	message := &Message{Connection: connection, Type: messageType, Data: msg, dispatch: dispatch}
+
+	next := connection.parent.middlewares.get()
+	if skipsMiddlewares(messageType, msg) {
+		next = dispatchMessage
+	}
+
+	if !connection.rateLimiter.enabled() {
+		next(message)
+		return
+	}
+
+	connection.interceptRateLimit(message, next)
+}
+
+// Acks, file chunks and the other control frames of the file transfer and reliable message protocols
+func skipsMiddlewares(messageType int, msg []byte) bool {
+	if messageType != ws.BinaryMessage {
+		return false
+	}
+
+	if kind, _, _, isReliableFrame := decodeReliableFrame(msg); isReliableFrame {
+		return kind != reliableFrame_Message
+	}
+	if len(msg) > len(fileFrameMagic) && bytes.HasPrefix(msg, fileFrameMagic) {
+		return msg[len(fileFrameMagic)] != fileFrame_Offer
+	}
+
+	return false
+}
+
+// Set as the base socket's stream interceptor, runs before 'OnMessageStream'
+func (connection *Connection) interceptMessageStream(messageType int, reader io.Reader, dispatch func(reader io.Reader) bool) bool {
+	// Buffered and intercepted as a regular message instead
+	if connection.OnMessageStream == nil {
+		return false
+	}
+
+	// Dropped unless the chain lets it through, whatever is left unread is then discarded
+	handled := true
+	message := &Message{Connection: connection, Type: messageType, Reader: reader}
+	message.dispatch = func([]byte) {
+		handled = dispatch(message.Reader)
+	}
+
+	next := connection.parent.middlewares.get()
+	if !connection.rateLimiter.enabled() {
+		next(message)
+		return handled
+	}
+
+	connection.interceptRateLimitStream(message, next)
+	return handled
+}
+
+//// Server methods
+
+// Adds middlewares wrapping the processing of every inbound message and request (parsers, 'OnRequest' and 'OnMessage'), in order: the first one added runs first
+//
+//	server.Use(func(next gows.Handler) gows.Handler {
+//		return func(message *gows.Message) {
+//			start := time.Now()
+//			next(message)
+//			log.Println(message.Connection.GetId(), time.Since(start))
+//		}
+//	})
+//
+// Middlewares added later apply to the connections already open. Streamed messages (see 'Connection.OnMessageStream') come with a 'Reader' instead of 'Data', reliable messages and file offers come as their protocol frames
+func (server *Server) Use(middlewares ...func(next Handler) Handler) {
+	server.middlewares.use(middlewares...)
+}
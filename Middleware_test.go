@@ -0,0 +1,85 @@
+package gows
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+func TestMiddlewareReplacesData(t *testing.T) {
+	server, proxy, _ := newTestServer(t, Server_Params{})
+	server.Use(func(next Handler) Handler {
+		return func(message *Message) {
+			message.Data = bytes.ToUpper(message.Data)
+			next(message)
+		}
+	})
+
+	received := make(chan string, 16)
+	connections := make(chan *Connection, 1)
+	server.OnConnect = func(connection *Connection) {
+		connection.OnMessage = func(messageType int, msg []byte) { received <- string(msg) }
+		connections <- connection
+	}
+
+	client := dialTestClient(t, proxy)
+	receive(t, connections)
+
+	client.SendText("hello")
+	expectText(t, received, "HELLO")
+}
+
+func TestMiddlewareFiltersReliableMessages(t *testing.T) {
+	options := ReliableOptions{AckTimeout: 100 * time.Millisecond, MaxAttempts: 50}
+	server, proxy, _ := newTestServer(t, Server_Params{Reliable: options})
+
+	// Drops every binary message until allowed, the reliable messages' acks skip the middlewares
+	var allow atomic.Bool
+	dropped := make(chan struct{}, 64)
+	server.Use(func(next Handler) Handler {
+		return func(message *Message) {
+			if !allow.Load() && message.Type == ws.BinaryMessage {
+				dropped <- struct{}{}
+				return
+			}
+			next(message)
+		}
+	})
+
+	received := make(chan string, 16)
+	connections := make(chan *Connection, 1)
+	server.OnConnect = func(connection *Connection) {
+		connection.OnReliableMessage = func(messageId string, msg []byte) { received <- string(msg) }
+		connections <- connection
+	}
+
+	client := dialTestClient(t, proxy, WithReliableOptions(options))
+	clientReceived := make(chan string, 16)
+	client.OnReliableMessage = func(messageId string, msg []byte) { clientReceived <- string(msg) }
+	connection := receive(t, connections)
+
+	// Acknowledged by the client, although the middleware drops the binary messages
+	connection.SendReliable([]byte("to the client"))
+	expectText(t, clientReceived, "to the client")
+	eventually(t, func() bool {
+		connection.reliable.mu.Lock()
+		defer connection.reliable.mu.Unlock()
+
+		return len(connection.reliable.pending) == 0
+	})
+
+	// Left unacknowledged while dropped, delivered once retransmitted after that
+	client.SendReliable([]byte("to the server"))
+	receive(t, dropped)
+	select {
+	case msg := <-received:
+		t.Fatalf("expected the middleware to drop %q", msg)
+	case <-time.After(2 * options.AckTimeout):
+	}
+
+	allow.Store(true)
+	expectText(t, received, "to the server")
+}
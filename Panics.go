@@ -0,0 +1,83 @@
+package gows
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/GTedZ/gows/websockets"
+	ws "github.com/gorilla/websocket"
+)
+
+// What happens to a connection once a panic in one of its callbacks has been recovered, see 'Server_Params.PanicAction'
+type PanicAction int
+
+const (
+	// The connection stays open, the message that caused the panic is dropped
+	PanicAction_Continue PanicAction = iota
+	// The connection is closed with 1011 (Internal Error)
+	PanicAction_Close
+)
+
+const PANIC_CLOSE_REASON = "internal error"
+
+//// Server
+
+// Deferred around the callbacks that don't run while reading from the connection (OnConnect, OnPresence, timers...), 'connection' is nil when there is none
+func (server *Server) recoverPanic(connection *Connection) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	server.onPanic(connection, recovered, debug.Stack())
+}
+
+func (server *Server) onPanic(connection *Connection, recovered interface{}, stack []byte) {
+	id := ""
+	if connection != nil {
+		id = connection.connectionId
+	}
+	websockets.Logger.ERROR(fmt.Sprintf("Recovered from a panic in a callback of connection '%s': %v\n%s", id, recovered, stack))
+
+	if server.OnPanic != nil {
+		func() {
+			// OnPanic itself mustn't crash the process either
+			defer func() {
+				recover()
+			}()
+			server.OnPanic(connection, recovered, stack)
+		}()
+	}
+
+	if connection != nil && server.panicAction == PanicAction_Close {
+		connection.CloseWithCode(ws.CloseInternalServerErr, PANIC_CLOSE_REASON)
+	}
+}
+
+// Set as the connection's 'SocketOptions.OnPanic', for the callbacks run while reading
+func (connection *Connection) onPanic(recovered interface{}, stack []byte) {
+	connection.parent.onPanic(connection, recovered, stack)
+}
+
+//// Client
+
+// Deferred around the callbacks that don't run while reading (reconnection, timers...)
+func (socket *Client) recoverPanic() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	socket.onPanic(recovered, debug.Stack())
+}
+
+func (socket *Client) onPanic(recovered interface{}, stack []byte) {
+	websockets.Logger.ERROR(fmt.Sprintf("Recovered from a panic in a callback: %v\n%s", recovered, stack))
+
+	if socket.OnPanic != nil {
+		defer func() {
+			recover()
+		}()
+		socket.OnPanic(recovered, stack)
+	}
+}
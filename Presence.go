@@ -0,0 +1,389 @@
+package gows
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Default time a principal stays present after its last connection closes, see 'Server_Params.PresenceDebounce'
+const PRESENCE_DEBOUNCE_SEC = 5
+
+type PresenceEventType int
+
+const (
+	// The principal's first connection joined
+	PresenceEvent_Join PresenceEventType = iota + 1
+	// The principal's last connection left (once the debounce has elapsed)
+	PresenceEvent_Leave
+	// One of the principal's connections joined, left or changed its metadata
+	PresenceEvent_Update
+)
+
+func (eventType PresenceEventType) String() string {
+	switch eventType {
+	case PresenceEvent_Join:
+		return "join"
+	case PresenceEvent_Leave:
+		return "leave"
+	case PresenceEvent_Update:
+		return "update"
+	}
+
+	return "unknown"
+}
+
+// Metadata a connection shows in the presence (status, device...), see 'Connection.SetPresence()'
+type PresenceMeta map[string]string
+
+// A principal present in a room or on the server, along with each of its connections
+//
+// Connections without a principal are tracked on their own, under their id
+type PresenceEntry struct {
+	Principal string
+	// Connection id -> its metadata
+	Connections map[string]PresenceMeta
+}
+
+type PresenceEvent struct {
+	Type PresenceEventType
+	// Empty for the server-wide presence, see 'Server.Online()'
+	Room string
+	// The principal after the event, its last connections for a leave
+	Entry PresenceEntry
+}
+
+// A room, or the whole server
+type presenceScope struct {
+	room   string
+	online bool
+}
+
+type principalPresence struct {
+	connections map[*Connection]struct{}
+
+	// Running while the principal has no connection left, the leave is emitted once it fires
+	leaving *time.Timer
+	// What the principal looked like before its last connection left, shown until then
+	last PresenceEntry
+}
+
+type presenceTracker struct {
+	// <= 0 emits leaves right away
+	debounce time.Duration
+	onEvent  func(event PresenceEvent)
+
+	// Also guards 'Connection.presenceMeta' and 'Connection.presenceClosed'
+	mu     sync.Mutex
+	scopes map[presenceScope]map[string]*principalPresence
+	// Connection -> the scopes it is tracked in
+	tracked map[*Connection]map[presenceScope]struct{}
+
+	// Events waiting to be emitted, in the order they happened, see 'emit()'
+	queue    []PresenceEvent
+	emitting bool
+}
+
+func (tracker *presenceTracker) init(debounce time.Duration, onEvent func(event PresenceEvent)) {
+	if debounce == 0 {
+		debounce = PRESENCE_DEBOUNCE_SEC * time.Second
+	}
+
+	tracker.debounce = debounce
+	tracker.onEvent = onEvent
+	tracker.scopes = make(map[presenceScope]map[string]*principalPresence)
+	tracker.tracked = make(map[*Connection]map[presenceScope]struct{})
+}
+
+func presenceKey(connection *Connection) string {
+	if connection.principal != "" {
+		return connection.principal
+	}
+
+	return connection.connectionId
+}
+
+// Must be called with the lock held
+func (tracker *presenceTracker) entry(key string, presence *principalPresence) PresenceEntry {
+	if len(presence.connections) == 0 {
+		return presence.last
+	}
+
+	entry := PresenceEntry{Principal: key, Connections: make(map[string]PresenceMeta, len(presence.connections))}
+	for connection := range presence.connections {
+		entry.Connections[connection.connectionId] = maps.Clone(connection.presenceMeta)
+	}
+
+	return entry
+}
+
+// Whether both hold the same metadata, regardless of the connection ids
+func samePresence(a PresenceEntry, b PresenceEntry) bool {
+	if len(a.Connections) != len(b.Connections) {
+		return false
+	}
+
+	unmatched := slices.Collect(maps.Values(b.Connections))
+	for _, meta := range a.Connections {
+		index := slices.IndexFunc(unmatched, func(other PresenceMeta) bool {
+			return maps.Equal(meta, other)
+		})
+		if index == -1 {
+			return false
+		}
+		unmatched = slices.Delete(unmatched, index, index+1)
+	}
+
+	return true
+}
+
+// Must be called with the lock held, the events are emitted by the next 'emit()'
+func (tracker *presenceTracker) enqueue(events ...PresenceEvent) {
+	if tracker.onEvent == nil {
+		return
+	}
+
+	tracker.queue = append(tracker.queue, events...)
+}
+
+// Emits the queued events in order, from a single goroutine at a time: the events queued while another goroutine is emitting are left to it
+//
+// So events are never reordered between concurrent changes, and 'OnPresence' can change the presence itself (e.g. through 'SetPresence()') without deadlocking
+func (tracker *presenceTracker) emit() {
+	tracker.mu.Lock()
+	if tracker.emitting {
+		tracker.mu.Unlock()
+		return
+	}
+	tracker.emitting = true
+
+	for len(tracker.queue) != 0 {
+		events := tracker.queue
+		tracker.queue = nil
+		tracker.mu.Unlock()
+
+		for _, event := range events {
+			tracker.onEvent(event)
+		}
+
+		tracker.mu.Lock()
+	}
+
+	tracker.emitting = false
+	tracker.mu.Unlock()
+}
+
+func (tracker *presenceTracker) track(connection *Connection, scopes ...presenceScope) {
+	tracker.mu.Lock()
+	for _, scope := range scopes {
+		event, changed := tracker.add(connection, scope)
+		if changed {
+			tracker.enqueue(event)
+		}
+	}
+	tracker.mu.Unlock()
+
+	tracker.emit()
+}
+
+// Must be called with the lock held
+func (tracker *presenceTracker) add(connection *Connection, scope presenceScope) (event PresenceEvent, changed bool) {
+	if _, exists := tracker.tracked[connection][scope]; exists {
+		return event, false
+	}
+	if connection.presenceClosed {
+		return event, false
+	}
+	// Rooms joined before the server's OnConnect returned, or by a closed connection whose session can still be resumed, are tracked once it is online
+	if _, online := tracker.tracked[connection][presenceScope{online: true}]; !online && !scope.online {
+		return event, false
+	}
+
+	if tracker.tracked[connection] == nil {
+		tracker.tracked[connection] = make(map[presenceScope]struct{})
+	}
+	tracker.tracked[connection][scope] = struct{}{}
+
+	if tracker.scopes[scope] == nil {
+		tracker.scopes[scope] = make(map[string]*principalPresence)
+	}
+
+	key := presenceKey(connection)
+	presence := tracker.scopes[scope][key]
+	if presence == nil {
+		presence = &principalPresence{connections: make(map[*Connection]struct{})}
+		tracker.scopes[scope][key] = presence
+
+		presence.connections[connection] = struct{}{}
+		return PresenceEvent{Type: PresenceEvent_Join, Room: scope.room, Entry: tracker.entry(key, presence)}, true
+	}
+
+	reconnected := presence.leaving != nil
+	if reconnected {
+		presence.leaving.Stop()
+		presence.leaving = nil
+	}
+
+	presence.connections[connection] = struct{}{}
+	entry := tracker.entry(key, presence)
+
+	// Back within the debounce, looking the same as before it left (new connection ids aside)
+	if reconnected && samePresence(entry, presence.last) {
+		return event, false
+	}
+
+	return PresenceEvent{Type: PresenceEvent_Update, Room: scope.room, Entry: entry}, true
+}
+
+func (tracker *presenceTracker) untrack(connection *Connection, scope presenceScope) {
+	tracker.mu.Lock()
+	event, changed := tracker.remove(connection, scope)
+	if changed {
+		tracker.enqueue(event)
+	}
+	tracker.mu.Unlock()
+
+	tracker.emit()
+}
+
+// Untracks 'connection' from everywhere, called once it is closed
+func (tracker *presenceTracker) untrackAll(connection *Connection) {
+	tracker.mu.Lock()
+	// Closed before being tracked, while OnConnect was running
+	connection.presenceClosed = true
+
+	for scope := range tracker.tracked[connection] {
+		event, changed := tracker.remove(connection, scope)
+		if changed {
+			tracker.enqueue(event)
+		}
+	}
+	tracker.mu.Unlock()
+
+	tracker.emit()
+}
+
+// Must be called with the lock held
+func (tracker *presenceTracker) remove(connection *Connection, scope presenceScope) (event PresenceEvent, changed bool) {
+	if _, exists := tracker.tracked[connection][scope]; !exists {
+		return event, false
+	}
+
+	delete(tracker.tracked[connection], scope)
+	if len(tracker.tracked[connection]) == 0 {
+		delete(tracker.tracked, connection)
+	}
+
+	key := presenceKey(connection)
+	presence := tracker.scopes[scope][key]
+	last := tracker.entry(key, presence)
+	delete(presence.connections, connection)
+
+	if len(presence.connections) != 0 {
+		return PresenceEvent{Type: PresenceEvent_Update, Room: scope.room, Entry: tracker.entry(key, presence)}, true
+	}
+
+	if tracker.debounce <= 0 {
+		tracker.forget(scope, key)
+		return PresenceEvent{Type: PresenceEvent_Leave, Room: scope.room, Entry: last}, true
+	}
+
+	presence.last = last
+	var timer *time.Timer
+	timer = time.AfterFunc(tracker.debounce, func() {
+		tracker.expire(scope, key, timer)
+	})
+	presence.leaving = timer
+
+	return event, false
+}
+
+// Emits the leave of a principal that didn't come back within the debounce
+func (tracker *presenceTracker) expire(scope presenceScope, key string, timer *time.Timer) {
+	tracker.mu.Lock()
+	presence := tracker.scopes[scope][key]
+	if presence == nil || presence.leaving != timer {
+		tracker.mu.Unlock()
+		return
+	}
+	tracker.forget(scope, key)
+	tracker.enqueue(PresenceEvent{Type: PresenceEvent_Leave, Room: scope.room, Entry: presence.last})
+	tracker.mu.Unlock()
+
+	tracker.emit()
+}
+
+// Must be called with the lock held
+func (tracker *presenceTracker) forget(scope presenceScope, key string) {
+	delete(tracker.scopes[scope], key)
+	if len(tracker.scopes[scope]) == 0 {
+		delete(tracker.scopes, scope)
+	}
+}
+
+func (tracker *presenceTracker) setMeta(connection *Connection, meta PresenceMeta) {
+	tracker.mu.Lock()
+	connection.presenceMeta = maps.Clone(meta)
+
+	key := presenceKey(connection)
+	for scope := range tracker.tracked[connection] {
+		tracker.enqueue(PresenceEvent{Type: PresenceEvent_Update, Room: scope.room, Entry: tracker.entry(key, tracker.scopes[scope][key])})
+	}
+	tracker.mu.Unlock()
+
+	tracker.emit()
+}
+
+// Hands the metadata of 'from' over to 'to', used when a session is resumed on a new connection
+func (tracker *presenceTracker) inherit(from *Connection, to *Connection) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	to.presenceMeta = from.presenceMeta
+}
+
+func (tracker *presenceTracker) list(scope presenceScope) []PresenceEntry {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	entries := make([]PresenceEntry, 0, len(tracker.scopes[scope]))
+	for key, presence := range tracker.scopes[scope] {
+		entries = append(entries, tracker.entry(key, presence))
+	}
+
+	return entries
+}
+
+//// Connection methods
+
+// Sets the metadata the connection shows in the presence of the server and of its rooms, emitting an update wherever it is present
+//
+// Kept by a session resumed on a new connection
+func (connection *Connection) SetPresence(meta PresenceMeta) {
+	connection.parent.presence.setMeta(connection, meta)
+}
+
+// Returns a copy of the metadata set through 'SetPresence()'
+func (connection *Connection) GetPresence() PresenceMeta {
+	tracker := &connection.parent.presence
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	return maps.Clone(connection.presenceMeta)
+}
+
+//// Server methods
+
+// Returns the principals present in 'room', in no particular order
+//
+// A principal whose last connection left stays present for 'Server_Params.PresenceDebounce', so that a reconnect doesn't make it flap
+func (server *Server) Presence(room string) []PresenceEntry {
+	return server.presence.list(presenceScope{room: room})
+}
+
+// Same as 'Presence()', for the principals connected to the server
+func (server *Server) Online() []PresenceEntry {
+	return server.presence.list(presenceScope{online: true})
+}
@@ -0,0 +1,179 @@
+package gows
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+)
+
+var onlineScope = presenceScope{online: true}
+
+func newTestPresenceTracker(debounce time.Duration) (*presenceTracker, <-chan PresenceEvent) {
+	events := make(chan PresenceEvent, 1024)
+
+	var tracker presenceTracker
+	tracker.init(debounce, func(event PresenceEvent) { events <- event })
+
+	return &tracker, events
+}
+
+func newPresenceConnection(principal string, connectionId string, meta PresenceMeta) *Connection {
+	return &Connection{principal: principal, connectionId: connectionId, presenceMeta: meta}
+}
+
+func expectPresence(t *testing.T, events <-chan PresenceEvent, eventType PresenceEventType, principal string, connections map[string]PresenceMeta) {
+	t.Helper()
+
+	event := receive(t, events)
+	if event.Type != eventType || event.Entry.Principal != principal {
+		t.Fatalf("expected a %s of %q, got a %s of %q", eventType, principal, event.Type, event.Entry.Principal)
+	}
+	if !maps.EqualFunc(event.Entry.Connections, connections, maps.Equal) {
+		t.Fatalf("expected the connections %v, got %v", connections, event.Entry.Connections)
+	}
+}
+
+func expectNoPresence(t *testing.T, events <-chan PresenceEvent, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		t.Fatalf("expected no presence event, got a %s of %q", event.Type, event.Entry.Principal)
+	case <-time.After(wait):
+	}
+}
+
+//// Debounce
+
+func TestPresenceLeaveAfterDebounce(t *testing.T) {
+	debounce := 50 * time.Millisecond
+	tracker, events := newTestPresenceTracker(debounce)
+
+	connection := newPresenceConnection("alice", "c1", PresenceMeta{"status": "busy"})
+	tracker.track(connection, onlineScope)
+	expectPresence(t, events, PresenceEvent_Join, "alice", map[string]PresenceMeta{"c1": {"status": "busy"}})
+
+	// Still present until the debounce elapses
+	tracker.untrackAll(connection)
+	expectNoPresence(t, events, debounce/2)
+	if len(tracker.list(onlineScope)) != 1 {
+		t.Fatal("expected the principal to stay present during the debounce")
+	}
+
+	// The leave shows what the principal looked like before leaving
+	expectPresence(t, events, PresenceEvent_Leave, "alice", map[string]PresenceMeta{"c1": {"status": "busy"}})
+	if len(tracker.list(onlineScope)) != 0 {
+		t.Fatal("expected the principal to be gone once it left")
+	}
+}
+
+func TestPresenceLeaveWithoutDebounce(t *testing.T) {
+	tracker, events := newTestPresenceTracker(-1)
+
+	connection := newPresenceConnection("alice", "c1", nil)
+	tracker.track(connection, onlineScope)
+	expectPresence(t, events, PresenceEvent_Join, "alice", map[string]PresenceMeta{"c1": nil})
+
+	tracker.untrackAll(connection)
+	expectPresence(t, events, PresenceEvent_Leave, "alice", map[string]PresenceMeta{"c1": nil})
+}
+
+func TestPresenceReconnectWithinDebounce(t *testing.T) {
+	debounce := 100 * time.Millisecond
+
+	t.Run("unchanged metadata", func(t *testing.T) {
+		tracker, events := newTestPresenceTracker(debounce)
+
+		first := newPresenceConnection("alice", "c1", PresenceMeta{"device": "phone"})
+		tracker.track(first, onlineScope)
+		expectPresence(t, events, PresenceEvent_Join, "alice", map[string]PresenceMeta{"c1": {"device": "phone"}})
+
+		// Back on a new connection, looking the same
+		tracker.untrackAll(first)
+		tracker.track(newPresenceConnection("alice", "c2", PresenceMeta{"device": "phone"}), onlineScope)
+
+		expectNoPresence(t, events, 2*debounce)
+	})
+
+	t.Run("changed metadata", func(t *testing.T) {
+		tracker, events := newTestPresenceTracker(debounce)
+
+		first := newPresenceConnection("alice", "c1", PresenceMeta{"device": "phone"})
+		tracker.track(first, onlineScope)
+		expectPresence(t, events, PresenceEvent_Join, "alice", map[string]PresenceMeta{"c1": {"device": "phone"}})
+
+		tracker.untrackAll(first)
+		tracker.track(newPresenceConnection("alice", "c2", PresenceMeta{"device": "laptop"}), onlineScope)
+		expectPresence(t, events, PresenceEvent_Update, "alice", map[string]PresenceMeta{"c2": {"device": "laptop"}})
+
+		// The pending leave was cancelled
+		expectNoPresence(t, events, 2*debounce)
+	})
+}
+
+//// Ordering
+
+func TestPresenceOrderedWhenOnPresenceSetsPresence(t *testing.T) {
+	events := make(chan PresenceEvent, 1024)
+
+	// Every principal marks itself online as soon as it joins, from within OnPresence
+	var tracker presenceTracker
+	var mu sync.Mutex
+	connections := make(map[string]*Connection)
+	tracker.init(-1, func(event PresenceEvent) {
+		events <- event
+
+		if event.Type == PresenceEvent_Join {
+			mu.Lock()
+			connection := connections[event.Entry.Principal]
+			mu.Unlock()
+
+			tracker.setMeta(connection, PresenceMeta{"status": "online"})
+		}
+	})
+
+	const principals = 50
+	var wg sync.WaitGroup
+	for i := range principals {
+		principal := fmt.Sprintf("user-%d", i)
+		connection := newPresenceConnection(principal, principal+"-c1", nil)
+
+		mu.Lock()
+		connections[principal] = connection
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.track(connection, onlineScope)
+		}()
+	}
+	wg.Wait()
+
+	// Each principal's join comes before the update its own OnPresence triggered
+	joined := make(map[string]bool)
+	for range 2 * principals {
+		event := receive(t, events)
+		principal := event.Entry.Principal
+
+		switch event.Type {
+		case PresenceEvent_Join:
+			if joined[principal] {
+				t.Fatalf("expected %q to join once", principal)
+			}
+			joined[principal] = true
+		case PresenceEvent_Update:
+			if !joined[principal] {
+				t.Fatalf("expected the join of %q before its update", principal)
+			}
+			if meta := event.Entry.Connections[principal+"-c1"]; meta["status"] != "online" {
+				t.Fatalf("expected the update of %q to carry its new metadata, got %v", principal, meta)
+			}
+		default:
+			t.Fatalf("unexpected %s of %q", event.Type, principal)
+		}
+	}
+	expectNoPresence(t, events, 50*time.Millisecond)
+}
@@ -0,0 +1,237 @@
+package gows
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+type RateLimitAction int
+
+const (
+	// The message is silently dropped
+	RateLimitAction_Drop RateLimitAction = iota
+	// The message is dropped and the client is sent an error (as a reply for requests)
+	RateLimitAction_ReplyError
+	// The connection is closed with 1008 (Policy Violation)
+	RateLimitAction_Close
+)
+
+const RATE_LIMIT_ERROR_MESSAGE = "rate limit exceeded"
+
+// Token-bucket limits applied to inbound messages of a single connection
+//
+// A zero-value RateLimit imposes no limit
+type RateLimit struct {
+	// Sustained amount of messages allowed per second, 0 means unlimited
+	MessagesPerSecond float64
+	// Amount of messages that can be received in a burst, defaults to 'MessagesPerSecond' (minimum 1)
+	MessageBurst int
+
+	// Sustained amount of bytes allowed per second, 0 means unlimited
+	BytesPerSecond float64
+	// Amount of bytes that can be received in a burst, defaults to 'BytesPerSecond'
+	ByteBurst int
+
+	Action RateLimitAction
+}
+
+//// Token Bucket
+
+// Not safe for concurrent use, see 'inboundLimiter'
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	bucketSize := float64(burst)
+	if bucketSize <= 0 {
+		bucketSize = math.Max(rate, 1)
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  bucketSize,
+		tokens: bucketSize,
+		last:   time.Now(),
+	}
+}
+
+// Whether 'n' tokens can be taken
+//
+// A single message bigger than the whole bucket is allowed once the bucket is full. A nil bucket always allows
+func (bucket *tokenBucket) available(n float64) bool {
+	if bucket == nil {
+		return true
+	}
+
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+
+	return bucket.tokens >= math.Min(n, bucket.burst)
+}
+
+// Takes 'n' tokens, the bucket goes negative when charged more than it holds, so that a big message is paid for in full before the next one is allowed
+func (bucket *tokenBucket) take(n float64) {
+	if bucket == nil {
+		return
+	}
+
+	bucket.tokens -= n
+}
+
+//// Connection Rate Limiter
+
+type inboundLimiter struct {
+	limit RateLimit
+
+	mu       sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func (limiter *inboundLimiter) init(limit RateLimit) {
+	limiter.limit = limit
+
+	limiter.messages = newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst)
+	limiter.bytes = newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+}
+
+func (limiter *inboundLimiter) enabled() bool {
+	return limiter.messages != nil || limiter.bytes != nil
+}
+
+// Charges both buckets if both allow the message, a rejected message isn't charged
+func (limiter *inboundLimiter) allow(size int) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	// Both are refilled, even when the first one already rejects
+	messagesAvailable := limiter.messages.available(1)
+	bytesAvailable := limiter.bytes.available(float64(size))
+	if !messagesAvailable || !bytesAvailable {
+		return false
+	}
+
+	limiter.messages.take(1)
+	limiter.bytes.take(float64(size))
+	return true
+}
+
+// Charges a streamed message, whose size is unknown until it has been read, it is allowed while the byte bucket isn't in debt
+func (limiter *inboundLimiter) allowStream() bool {
+	return limiter.allow(0)
+}
+
+// Charges 'n' bytes read from a streamed message, returning how long to wait for the byte bucket to be out of debt
+func (limiter *inboundLimiter) charge(n int) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.bytes == nil {
+		return 0
+	}
+
+	limiter.bytes.available(0)
+	limiter.bytes.take(float64(n))
+	if limiter.bytes.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.bytes.tokens / limiter.bytes.rate * float64(time.Second))
+}
+
+// Paces the reading of a streamed message to the byte rate limit
+type throttledReader struct {
+	reader  io.Reader
+	limiter *inboundLimiter
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		time.Sleep(reader.limiter.charge(n))
+	}
+
+	return n, err
+}
+
+// Separate limits for private requests and plain messages
+type connectionRateLimiter struct {
+	messages inboundLimiter
+	requests inboundLimiter
+}
+
+func (limiter *connectionRateLimiter) init(messageLimit RateLimit, requestLimit RateLimit) {
+	limiter.messages.init(messageLimit)
+	limiter.requests.init(requestLimit)
+}
+
+func (limiter *connectionRateLimiter) enabled() bool {
+	return limiter.messages.enabled() || limiter.requests.enabled()
+}
+
+func (limiter *connectionRateLimiter) get(isRequest bool) *inboundLimiter {
+	if isRequest {
+		return &limiter.requests
+	}
+
+	return &limiter.messages
+}
+
+//// Connection hooks
+
+// Runs before the middlewares when rate limiting is enabled, see 'interceptMessage()'
+func (connection *Connection) interceptRateLimit(message *Message, next Handler) {
+	requestId, isRequest := message.Request()
+
+	limiter := connection.rateLimiter.get(isRequest)
+	if limiter.allow(len(message.Data)) {
+		next(message)
+		return
+	}
+
+	connection.rejectRateLimited(limiter, isRequest, requestId)
+}
+
+// Same as 'interceptRateLimit()' for a streamed message, which is then read no faster than the byte rate limit
+func (connection *Connection) interceptRateLimitStream(message *Message, next Handler) {
+	limiter := connection.rateLimiter.get(false)
+	if !limiter.allowStream() {
+		connection.rejectRateLimited(limiter, false, "")
+		return
+	}
+
+	if limiter.bytes != nil {
+		message.Reader = &throttledReader{reader: message.Reader, limiter: limiter}
+	}
+	next(message)
+}
+
+func (connection *Connection) rejectRateLimited(limiter *inboundLimiter, isRequest bool, requestId string) {
+	if connection.parent.OnRateLimited != nil {
+		connection.parent.OnRateLimited(connection, isRequest)
+	}
+
+	switch limiter.limit.Action {
+	case RateLimitAction_ReplyError:
+		reply := map[string]interface{}{"error": RATE_LIMIT_ERROR_MESSAGE}
+		if isRequest {
+			reply[connection.parent.privateMessagePropertyName] = requestId
+		}
+		connection.SendJSON(reply)
+	case RateLimitAction_Close:
+		connection.base.CloseWithCode(ws.ClosePolicyViolation, RATE_LIMIT_ERROR_MESSAGE)
+	}
+}
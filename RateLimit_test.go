@@ -0,0 +1,291 @@
+package gows
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// Moves the bucket's clock back, as if 'd' had passed since its last refill
+func (bucket *tokenBucket) elapse(d time.Duration) {
+	bucket.last = bucket.last.Add(-d)
+}
+
+//// Token Bucket
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	bucket := newTokenBucket(10, 3)
+
+	for i := range 3 {
+		if !bucket.available(1) {
+			t.Fatalf("expected message %d of the burst to be allowed", i)
+		}
+		bucket.take(1)
+	}
+	if bucket.available(1) {
+		t.Fatal("expected the bucket to be empty after its burst")
+	}
+
+	// 10 tokens per second, so 2 tokens after 200ms
+	bucket.elapse(200 * time.Millisecond)
+	if !bucket.available(2) {
+		t.Fatal("expected the bucket to refill")
+	}
+	bucket.take(2)
+	if bucket.available(1) {
+		t.Fatal("expected the refill to be spent")
+	}
+
+	// Never refilled past its burst
+	bucket.elapse(time.Hour)
+	bucket.available(0)
+	if bucket.tokens != 3 {
+		t.Fatalf("expected the bucket to be capped at its burst, got %v tokens", bucket.tokens)
+	}
+}
+
+func TestTokenBucketDefaults(t *testing.T) {
+	if newTokenBucket(0, 10) != nil {
+		t.Fatal("expected no bucket without a rate")
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.available(1e9) {
+		t.Fatal("expected a nil bucket to always allow")
+	}
+
+	if bucket := newTokenBucket(5, 0); bucket.burst != 5 {
+		t.Fatalf("expected the burst to default to the rate, got %v", bucket.burst)
+	}
+	if bucket := newTokenBucket(0.5, 0); bucket.burst != 1 {
+		t.Fatalf("expected the burst to be at least 1, got %v", bucket.burst)
+	}
+}
+
+func TestTokenBucketOversizedCost(t *testing.T) {
+	bucket := newTokenBucket(100, 100)
+
+	// Allowed once full, then paid for in full
+	if !bucket.available(250) {
+		t.Fatal("expected a cost bigger than the burst to be allowed by a full bucket")
+	}
+	bucket.take(250)
+	if bucket.tokens != -150 {
+		t.Fatalf("expected the bucket to go into debt, got %v tokens", bucket.tokens)
+	}
+
+	bucket.elapse(time.Second)
+	if bucket.available(1) {
+		t.Fatal("expected the debt to be paid off before the next cost")
+	}
+	bucket.elapse(600 * time.Millisecond)
+	if !bucket.available(1) {
+		t.Fatal("expected the bucket to allow once out of debt")
+	}
+}
+
+//// Inbound Limiter
+
+func TestInboundLimiterCosts(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit RateLimit
+		sizes []int
+		// Whether each message of 'sizes' is allowed
+		expected []bool
+	}{
+		{
+			name:     "unlimited",
+			limit:    RateLimit{},
+			sizes:    []int{1 << 20, 1 << 20, 1 << 20},
+			expected: []bool{true, true, true},
+		},
+		{
+			name:     "messages cost one token each",
+			limit:    RateLimit{MessagesPerSecond: 1, MessageBurst: 2},
+			sizes:    []int{1 << 20, 1 << 20, 0},
+			expected: []bool{true, true, false},
+		},
+		{
+			name:     "bytes cost their size",
+			limit:    RateLimit{BytesPerSecond: 1, ByteBurst: 100},
+			sizes:    []int{60, 60, 40},
+			expected: []bool{true, false, true},
+		},
+		{
+			name:     "a message must be allowed by both buckets",
+			limit:    RateLimit{MessagesPerSecond: 1, MessageBurst: 2, BytesPerSecond: 1, ByteBurst: 100},
+			sizes:    []int{150, 50, 10},
+			expected: []bool{true, false, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var limiter inboundLimiter
+			limiter.init(test.limit)
+
+			for i, size := range test.sizes {
+				if allowed := limiter.allow(size); allowed != test.expected[i] {
+					t.Fatalf("expected message %d (%d bytes) to be allowed: %v, got %v", i, size, test.expected[i], allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestInboundLimiterRejectedIsNotCharged(t *testing.T) {
+	var limiter inboundLimiter
+	limiter.init(RateLimit{MessagesPerSecond: 1, MessageBurst: 1, BytesPerSecond: 1, ByteBurst: 100})
+
+	if !limiter.allow(60) {
+		t.Fatal("expected the first message to be allowed")
+	}
+
+	// Rejected by the message bucket, the byte bucket keeps its 40 tokens
+	if limiter.allow(30) {
+		t.Fatal("expected the message bucket to reject")
+	}
+	limiter.messages.elapse(time.Second)
+
+	// Rejected by the byte bucket, the message bucket keeps its token
+	if limiter.allow(50) {
+		t.Fatal("expected the byte bucket to reject")
+	}
+	if !limiter.allow(40) {
+		t.Fatal("expected the rejected messages not to have been charged")
+	}
+}
+
+func TestInboundLimiterStream(t *testing.T) {
+	var limiter inboundLimiter
+	limiter.init(RateLimit{BytesPerSecond: 1000, ByteBurst: 100})
+
+	if !limiter.allowStream() {
+		t.Fatal("expected a stream to be allowed while the byte bucket isn't in debt")
+	}
+
+	// Read as it comes, the reader then waits for the debt to be paid off
+	if wait := limiter.charge(100); wait != 0 {
+		t.Fatalf("expected no wait within the burst, got %v", wait)
+	}
+	wait := limiter.charge(500)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("expected to wait about 500ms, got %v", wait)
+	}
+	if limiter.allowStream() {
+		t.Fatal("expected no stream to be allowed while in debt")
+	}
+
+	var unlimited inboundLimiter
+	unlimited.init(RateLimit{MessagesPerSecond: 1})
+	if wait := unlimited.charge(1 << 20); wait != 0 {
+		t.Fatalf("expected no wait without a byte limit, got %v", wait)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	var limiter inboundLimiter
+	limiter.init(RateLimit{BytesPerSecond: 10000, ByteBurst: 1000})
+
+	data := bytes.Repeat([]byte("x"), 3000)
+	reader := &throttledReader{reader: bytes.NewReader(data), limiter: &limiter}
+
+	start := time.Now()
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(read, data) {
+		t.Fatal("expected the whole stream to be read")
+	}
+	// 2000 bytes over the burst, at 10000 bytes per second
+	if elapsed < 150*time.Millisecond {
+		t.Fatalf("expected the reading to be paced, took %v", elapsed)
+	}
+}
+
+//// Actions
+
+func TestRateLimitActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		action RateLimitAction
+		// Checks what the client got once its second message was rejected
+		check func(t *testing.T, received <-chan string, closed <-chan CloseInfo)
+	}{
+		{
+			name:   "drop",
+			action: RateLimitAction_Drop,
+			check: func(t *testing.T, received <-chan string, closed <-chan CloseInfo) {
+				select {
+				case msg := <-received:
+					t.Fatalf("expected nothing to be sent back, got %q", msg)
+				case info := <-closed:
+					t.Fatalf("expected the connection to stay open, got closed with %d", info.Code)
+				case <-time.After(100 * time.Millisecond):
+				}
+			},
+		},
+		{
+			name:   "reply error",
+			action: RateLimitAction_ReplyError,
+			check: func(t *testing.T, received <-chan string, closed <-chan CloseInfo) {
+				expectText(t, received, `{"error":"`+RATE_LIMIT_ERROR_MESSAGE+`"}`)
+			},
+		},
+		{
+			name:   "close",
+			action: RateLimitAction_Close,
+			check: func(t *testing.T, received <-chan string, closed <-chan CloseInfo) {
+				if info := receive(t, closed); info.Code != ws.ClosePolicyViolation || !info.Local {
+					t.Fatalf("expected the server to close with %d, got %+v", ws.ClosePolicyViolation, info)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, proxy, _ := newTestServer(t, Server_Params{
+				MessageRateLimit: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 1, Action: test.action},
+			})
+
+			messages := make(chan string, 16)
+			rejected := make(chan bool, 16)
+			closed := make(chan CloseInfo, 1)
+			connections := make(chan *Connection, 1)
+			server.OnRateLimited = func(connection *Connection, isRequest bool) { rejected <- isRequest }
+			server.OnClose = func(connection *Connection, info CloseInfo) { closed <- info }
+			server.OnConnect = func(connection *Connection) {
+				connection.OnMessage = func(messageType int, msg []byte) { messages <- string(msg) }
+				connections <- connection
+			}
+
+			received := make(chan string, 16)
+			client := dialTestClient(t, proxy)
+			client.OnMessage = func(messageType int, msg []byte) { received <- string(msg) }
+			receive(t, connections)
+
+			client.SendText("first")
+			expectText(t, messages, "first")
+
+			client.SendText("second")
+			if isRequest := receive(t, rejected); isRequest {
+				t.Fatal("expected a plain message to be rejected")
+			}
+			test.check(t, received, closed)
+
+			select {
+			case msg := <-messages:
+				t.Fatalf("expected %q to be rejected", msg)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package gows
+
+import "sync"
+
+// Set of a server's active connections
+//
+// The lock is never held while calling back into user code, so connections can safely be closed (or the registry used again) from within 'Range()' and 'OnLenChange'
+type ConnectionRegistry struct {
+	mu          sync.RWMutex
+	connections map[string]*Connection
+
+	// Serializes the OnLenChange calls
+	notifyMu sync.Mutex
+
+	// Called with the current amount of connections every time one is added or removed
+	//
+	// NOTE: Calls are made one at a time, but concurrent changes may be reported as a single count twice
+	OnLenChange func(count int)
+}
+
+func (registry *ConnectionRegistry) init() {
+	registry.connections = make(map[string]*Connection)
+}
+
+func (registry *ConnectionRegistry) add(connection *Connection) {
+	registry.mu.Lock()
+	registry.connections[connection.GetId()] = connection
+	registry.mu.Unlock()
+
+	registry.notifyLenChange()
+}
+
+func (registry *ConnectionRegistry) remove(connection *Connection) {
+	registry.mu.Lock()
+	// A resumed session's new connection takes over the id of the previous one, which may close after it
+	exists := registry.connections[connection.GetId()] == connection
+	if exists {
+		delete(registry.connections, connection.GetId())
+	}
+	registry.mu.Unlock()
+
+	if exists {
+		registry.notifyLenChange()
+	}
+}
+
+func (registry *ConnectionRegistry) notifyLenChange() {
+	if registry.OnLenChange == nil {
+		return
+	}
+
+	registry.notifyMu.Lock()
+	defer registry.notifyMu.Unlock()
+
+	registry.OnLenChange(registry.Count())
+}
+
+// Returns a copy of the current connections, in no particular order
+func (registry *ConnectionRegistry) snapshot() []*Connection {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	connections := make([]*Connection, 0, len(registry.connections))
+	for _, connection := range registry.connections {
+		connections = append(connections, connection)
+	}
+
+	return connections
+}
+
+//// Public methods
+
+func (registry *ConnectionRegistry) Get(id string) (connection *Connection, exists bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	connection, exists = registry.connections[id]
+	return connection, exists
+}
+
+// Calls 'callback' for every connection, until it returns false
+//
+// Iterates over a snapshot, so connections added meanwhile are skipped and connections closed meanwhile may still be visited
+func (registry *ConnectionRegistry) Range(callback func(connection *Connection) bool) {
+	for _, connection := range registry.snapshot() {
+		if !callback(connection) {
+			return
+		}
+	}
+}
+
+func (registry *ConnectionRegistry) Count() int {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	return len(registry.connections)
+}
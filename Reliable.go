@@ -0,0 +1,458 @@
+package gows
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time to wait for an ack before retransmitting a reliable message
+	RELIABLE_ACK_TIMEOUT_SEC = 5
+	// Default amount of transmissions after which an unacknowledged reliable message is given up on
+	RELIABLE_MAX_ATTEMPTS = 5
+	// Default amount of received message ids remembered to drop duplicates
+	RELIABLE_DEDUP_WINDOW = 4096
+	// Default time the server keeps the reliable stream of a disconnected client, see 'ReliableOptions.StreamTTL'
+	RELIABLE_STREAM_TTL_SEC = 2 * 60
+
+	// Handshake header carrying the random id a Client keeps across reconnections, so that the server hands its reliable stream over to the new connection
+	STREAM_HEADER = "Gows-Stream"
+)
+
+// Wrapped by the error passed to 'OnDeliveryFailed', along with the reason
+var ErrDeliveryFailed = errors.New("reliable message was not acknowledged")
+
+// Settings of the reliable messages, see 'SendReliable()'
+type ReliableOptions struct {
+	// Time to wait for an ack before retransmitting, 0 uses RELIABLE_ACK_TIMEOUT_SEC
+	AckTimeout time.Duration
+	// Transmissions after which an unacknowledged message is given up on, 0 uses RELIABLE_MAX_ATTEMPTS
+	//
+	// Attempts made while disconnected don't count
+	MaxAttempts int
+	// Amount of received message ids remembered to drop duplicates, 0 uses RELIABLE_DEDUP_WINDOW
+	DedupWindow int
+	// Server only: how long the stream of a disconnected client (its pending messages and dedup window) is kept for it to reconnect, 0 uses RELIABLE_STREAM_TTL_SEC
+	//
+	// Pending messages are given up on once it expires
+	StreamTTL time.Duration
+}
+
+//// Frames
+
+// Every frame is a binary message starting with the magic, followed by the frame kind, the id length (1 byte) and the id
+//
+// Messages then carry their payload, acks carry nothing else
+var reliableFrameMagic = []byte("GWRM")
+
+const (
+	reliableFrame_Message byte = iota + 1
+	reliableFrame_Ack
+)
+
+func encodeReliableFrame(kind byte, messageId string, payload []byte) []byte {
+	frame := make([]byte, 0, len(reliableFrameMagic)+2+len(messageId)+len(payload))
+	frame = append(frame, reliableFrameMagic...)
+	frame = append(frame, kind, byte(len(messageId)))
+	frame = append(frame, messageId...)
+	return append(frame, payload...)
+}
+
+func decodeReliableFrame(msg []byte) (kind byte, messageId string, payload []byte, isReliableFrame bool) {
+	header := len(reliableFrameMagic) + 2
+	if len(msg) < header || !bytes.HasPrefix(msg, reliableFrameMagic) {
+		return 0, "", nil, false
+	}
+
+	kind = msg[len(reliableFrameMagic)]
+	idLength := int(msg[len(reliableFrameMagic)+1])
+	if len(msg) < header+idLength {
+		return 0, "", nil, false
+	}
+
+	return kind, string(msg[header : header+idLength]), msg[header+idLength:], true
+}
+
+//// Channel
+
+// Implemented by Client and Connection
+type reliablePeer interface {
+	sendReliableFrame(frame []byte) error
+	onReliableMessage(messageId string, msg []byte) (delivered bool)
+	onDeliveryFailed(messageId string, msg []byte, err error)
+}
+
+type pendingReliableMessage struct {
+	id    string
+	msg   []byte
+	frame []byte
+
+	// Order in which the messages were sent, kept by retransmissions
+	order uint64
+	// Transmissions that went through
+	attempts int
+	timer    *time.Timer
+}
+
+// Sends and receives the reliable messages of a single Client or Connection (shared by the connections of the same stream or resumed session)
+type reliableChannel struct {
+	options ReliableOptions
+
+	mu   sync.Mutex
+	peer reliablePeer
+	// Set once the channel can no longer deliver anything
+	err error
+
+	pending   map[string]*pendingReliableMessage
+	nextOrder uint64
+
+	// The last received message ids, 'receivedRing' is used to forget the oldest ones
+	received     map[string]struct{}
+	receivedRing []string
+	receivedNext int
+}
+
+func newReliableChannel(peer reliablePeer, options ReliableOptions) *reliableChannel {
+	if options.AckTimeout <= 0 {
+		options.AckTimeout = RELIABLE_ACK_TIMEOUT_SEC * time.Second
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = RELIABLE_MAX_ATTEMPTS
+	}
+	if options.DedupWindow <= 0 {
+		options.DedupWindow = RELIABLE_DEDUP_WINDOW
+	}
+
+	return &reliableChannel{
+		options:  options,
+		peer:     peer,
+		pending:  make(map[string]*pendingReliableMessage),
+		received: make(map[string]struct{}),
+	}
+}
+
+// Used when a session is resumed on a new connection
+func (channel *reliableChannel) setPeer(peer reliablePeer) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	channel.peer = peer
+}
+
+func (channel *reliableChannel) send(messageId string, msg []byte) error {
+	if messageId == "" || len(messageId) > 255 {
+		return fmt.Errorf("reliable message ids must be 1 to 255 bytes long, got %d", len(messageId))
+	}
+
+	channel.mu.Lock()
+	if channel.err != nil {
+		channel.mu.Unlock()
+		return channel.err
+	}
+	if _, exists := channel.pending[messageId]; exists {
+		channel.mu.Unlock()
+		return fmt.Errorf("reliable message %q is already pending", messageId)
+	}
+
+	pending := &pendingReliableMessage{
+		id:    messageId,
+		msg:   slices.Clone(msg),
+		frame: encodeReliableFrame(reliableFrame_Message, messageId, msg),
+		order: channel.nextOrder,
+	}
+	channel.nextOrder++
+	channel.pending[messageId] = pending
+	channel.mu.Unlock()
+
+	channel.transmit(pending)
+	return nil
+}
+
+// Sends 'pending' and waits for its ack, a failed send (while disconnected) is retried without counting as an attempt
+func (channel *reliableChannel) transmit(pending *pendingReliableMessage) {
+	channel.mu.Lock()
+	peer := channel.peer
+	channel.mu.Unlock()
+
+	err := peer.sendReliableFrame(pending.frame)
+
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	// Acknowledged or given up on meanwhile
+	if channel.pending[pending.id] != pending {
+		return
+	}
+
+	if err == nil {
+		pending.attempts++
+	}
+
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	pending.timer = time.AfterFunc(channel.options.AckTimeout, func() {
+		channel.onTimeout(pending)
+	})
+}
+
+func (channel *reliableChannel) onTimeout(pending *pendingReliableMessage) {
+	channel.mu.Lock()
+	if channel.pending[pending.id] != pending {
+		channel.mu.Unlock()
+		return
+	}
+
+	if pending.attempts < channel.options.MaxAttempts {
+		channel.mu.Unlock()
+		channel.transmit(pending)
+		return
+	}
+
+	delete(channel.pending, pending.id)
+	peer := channel.peer
+	channel.mu.Unlock()
+
+	peer.onDeliveryFailed(pending.id, pending.msg, fmt.Errorf("%w after %d attempts", ErrDeliveryFailed, pending.attempts))
+}
+
+// Retransmits every pending message in the order they were sent, called once reconnected
+func (channel *reliableChannel) resend() {
+	channel.mu.Lock()
+	pending := make([]*pendingReliableMessage, 0, len(channel.pending))
+	for _, message := range channel.pending {
+		pending = append(pending, message)
+	}
+	channel.mu.Unlock()
+
+	slices.SortFunc(pending, func(a, b *pendingReliableMessage) int {
+		return cmp.Compare(a.order, b.order)
+	})
+
+	for _, message := range pending {
+		channel.transmit(message)
+	}
+}
+
+// Fails every pending message with 'err', later sends return it right away
+func (channel *reliableChannel) close(err error) {
+	channel.mu.Lock()
+	channel.err = err
+	pending := channel.pending
+	channel.pending = make(map[string]*pendingReliableMessage)
+	for _, message := range pending {
+		if message.timer != nil {
+			message.timer.Stop()
+		}
+	}
+	peer := channel.peer
+	channel.mu.Unlock()
+
+	for _, message := range pending {
+		peer.onDeliveryFailed(message.id, message.msg, fmt.Errorf("%w: %w", ErrDeliveryFailed, err))
+	}
+}
+
+// Returns false if 'msg' isn't a reliable message frame
+func (channel *reliableChannel) handleFrame(msg []byte) bool {
+	kind, messageId, payload, isReliableFrame := decodeReliableFrame(msg)
+	if !isReliableFrame {
+		return false
+	}
+
+	switch kind {
+	case reliableFrame_Message:
+		channel.receive(messageId, payload)
+	case reliableFrame_Ack:
+		channel.acknowledge(messageId)
+	}
+
+	return true
+}
+
+// Delivers the message unless it is a duplicate, then acks it either way
+//
+// A message that couldn't be delivered (no handler set yet) is neither remembered nor acked, so that its retransmission gets delivered
+func (channel *reliableChannel) receive(messageId string, payload []byte) {
+	channel.mu.Lock()
+	_, duplicate := channel.received[messageId]
+	peer := channel.peer
+	channel.mu.Unlock()
+
+	if !duplicate {
+		// Acknowledged only once processed, so that it gets retransmitted if the connection drops meanwhile
+		if !peer.onReliableMessage(messageId, payload) {
+			return
+		}
+
+		channel.mu.Lock()
+		channel.remember(messageId)
+		channel.mu.Unlock()
+	}
+
+	peer.sendReliableFrame(encodeReliableFrame(reliableFrame_Ack, messageId, nil))
+}
+
+// Must be called with the lock held
+func (channel *reliableChannel) remember(messageId string) {
+	channel.received[messageId] = struct{}{}
+
+	if len(channel.receivedRing) < channel.options.DedupWindow {
+		channel.receivedRing = append(channel.receivedRing, messageId)
+		return
+	}
+
+	delete(channel.received, channel.receivedRing[channel.receivedNext])
+	channel.receivedRing[channel.receivedNext] = messageId
+	channel.receivedNext = (channel.receivedNext + 1) % len(channel.receivedRing)
+}
+
+func (channel *reliableChannel) acknowledge(messageId string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	pending, exists := channel.pending[messageId]
+	if !exists {
+		return
+	}
+
+	delete(channel.pending, messageId)
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+}
+
+//// Streams
+
+// Keeps the reliable channel of each client across its connections, see STREAM_HEADER (its outgoing file transfers follow it as well, see 'Connection.waitForReconnect()')
+//
+// A stream is keyed by the client's id and principal, so that only the same principal can take it over
+type reliableStreamStore struct {
+	options ReliableOptions
+
+	mu      sync.Mutex
+	streams map[reliableStreamKey]*reliableStream
+}
+
+type reliableStreamKey struct {
+	principal string
+	id        string
+}
+
+type reliableStream struct {
+	channel *reliableChannel
+	// The latest connection of the stream
+	connection *Connection
+	attached   bool
+
+	// Bumped every time the stream is attached or detached, so that stale expiry timers are ignored
+	generation int
+	expiry     *time.Timer
+	// Closed (and replaced) every time the stream is attached or expires, see 'next()'
+	changed chan struct{}
+}
+
+func (store *reliableStreamStore) init(options ReliableOptions) {
+	if options.StreamTTL <= 0 {
+		options.StreamTTL = RELIABLE_STREAM_TTL_SEC * time.Second
+	}
+
+	store.options = options
+	store.streams = make(map[reliableStreamKey]*reliableStream)
+}
+
+// Returns the channel of the stream 'id', creating it if needed, 'resumed' is true when it was taken over from a previous connection
+//
+// The previous connection may not have been closed yet (e.g. its client's network dropped), the stream then moves on without waiting for it
+func (store *reliableStreamStore) attach(connection *Connection, id string) (channel *reliableChannel, resumed bool) {
+	key := reliableStreamKey{principal: connection.principal, id: id}
+
+	store.mu.Lock()
+	stream, resumed := store.streams[key]
+	if !resumed {
+		stream = &reliableStream{channel: newReliableChannel(connection, store.options), changed: make(chan struct{})}
+		store.streams[key] = stream
+	}
+
+	stream.connection = connection
+	stream.attached = true
+	stream.generation++
+	if stream.expiry != nil {
+		stream.expiry.Stop()
+	}
+	close(stream.changed)
+	stream.changed = make(chan struct{})
+	store.mu.Unlock()
+
+	if resumed {
+		stream.channel.setPeer(connection)
+	}
+
+	return stream.channel, resumed
+}
+
+// Called once 'connection' has been closed, its stream then waits for the client to reconnect
+func (store *reliableStreamStore) detach(connection *Connection) {
+	key := reliableStreamKey{principal: connection.principal, id: connection.reliableStream}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stream := store.streams[key]
+	if stream == nil || stream.connection != connection || !stream.attached {
+		return
+	}
+	stream.attached = false
+
+	stream.generation++
+	generation := stream.generation
+	stream.expiry = time.AfterFunc(store.options.StreamTTL, func() {
+		store.expire(key, stream, generation)
+	})
+}
+
+// Gives up on the pending messages of a stream whose client didn't reconnect in time
+func (store *reliableStreamStore) expire(key reliableStreamKey, stream *reliableStream, generation int) {
+	store.mu.Lock()
+	if store.streams[key] != stream || stream.generation != generation {
+		store.mu.Unlock()
+		return
+	}
+	delete(store.streams, key)
+	close(stream.changed)
+	store.mu.Unlock()
+
+	stream.channel.close(ErrDisconnected)
+}
+
+// Blocks until the client of 'connection' reconnects and returns its new connection, or returns ErrDisconnected once the stream expires
+func (store *reliableStreamStore) next(ctx context.Context, connection *Connection) (*Connection, error) {
+	key := reliableStreamKey{principal: connection.principal, id: connection.reliableStream}
+
+	for {
+		store.mu.Lock()
+		stream := store.streams[key]
+		if stream == nil {
+			store.mu.Unlock()
+			return nil, ErrDisconnected
+		}
+		if stream.attached && stream.connection != connection {
+			store.mu.Unlock()
+			return stream.connection, nil
+		}
+		changed := stream.changed
+		store.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
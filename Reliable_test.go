@@ -0,0 +1,264 @@
+package gows
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what a reliable channel delivers and sends
+type fakeReliablePeer struct {
+	mu        sync.Mutex
+	delivered []string
+	acked     []string
+	// Whether a handler is set, see 'reliablePeer.onReliableMessage()'
+	deliver bool
+}
+
+func (peer *fakeReliablePeer) sendReliableFrame(frame []byte) error {
+	kind, messageId, _, _ := decodeReliableFrame(frame)
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if kind == reliableFrame_Ack {
+		peer.acked = append(peer.acked, messageId)
+	}
+	return nil
+}
+
+func (peer *fakeReliablePeer) onReliableMessage(messageId string, msg []byte) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if !peer.deliver {
+		return false
+	}
+	peer.delivered = append(peer.delivered, string(msg))
+	return true
+}
+
+func (peer *fakeReliablePeer) onDeliveryFailed(messageId string, msg []byte, err error) {}
+
+func (peer *fakeReliablePeer) check(t *testing.T, delivered []string, acked []string) {
+	t.Helper()
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if !slices.Equal(peer.delivered, delivered) {
+		t.Fatalf("expected %q to be delivered, got %q", delivered, peer.delivered)
+	}
+	if !slices.Equal(peer.acked, acked) {
+		t.Fatalf("expected %q to be acked, got %q", acked, peer.acked)
+	}
+}
+
+func receiveReliableMessage(channel *reliableChannel, messageId string, msg string) {
+	channel.handleFrame(encodeReliableFrame(reliableFrame_Message, messageId, []byte(msg)))
+}
+
+func TestReliableDedup(t *testing.T) {
+	peer := &fakeReliablePeer{deliver: true}
+	channel := newReliableChannel(peer, ReliableOptions{DedupWindow: 2})
+
+	// Retransmitted because its ack was lost, acked again without being delivered again
+	receiveReliableMessage(channel, "a", "first")
+	receiveReliableMessage(channel, "a", "first")
+	peer.check(t, []string{"first"}, []string{"a", "a"})
+
+	// Only the last 2 ids are remembered
+	receiveReliableMessage(channel, "b", "second")
+	receiveReliableMessage(channel, "c", "third")
+	receiveReliableMessage(channel, "c", "third")
+	receiveReliableMessage(channel, "a", "first")
+	peer.check(t, []string{"first", "second", "third", "first"}, []string{"a", "a", "b", "c", "c", "a"})
+}
+
+func TestReliableUndeliveredIsNotAcked(t *testing.T) {
+	peer := &fakeReliablePeer{}
+	channel := newReliableChannel(peer, ReliableOptions{})
+
+	receiveReliableMessage(channel, "a", "first")
+	peer.check(t, nil, nil)
+
+	// Neither remembered nor acked, so its retransmission is delivered once a handler is set
+	peer.deliver = true
+	receiveReliableMessage(channel, "a", "first")
+	peer.check(t, []string{"first"}, []string{"a"})
+}
+
+func TestReliableLostAckAcrossReconnect(t *testing.T) {
+	options := ReliableOptions{AckTimeout: 100 * time.Millisecond, MaxAttempts: 50}
+	server, proxy, _ := newTestServer(t, Server_Params{Reliable: options, Sessions: SessionOptions{Enabled: true}})
+
+	received := make(chan string, 16)
+	connections := make(chan *Connection, 16)
+	server.OnConnect = func(connection *Connection) {
+		connection.OnReliableMessage = func(messageId string, msg []byte) { received <- string(msg) }
+		connections <- connection
+	}
+
+	failed := make(chan string, 16)
+	client := dialTestClient(t, proxy, WithSessionResumption(), WithReliableOptions(options))
+	client.OnDeliveryFailed = func(messageId string, msg []byte, err error) { failed <- messageId }
+	receive(t, connections)
+
+	// The server receives the message, but its acks never make it back
+	proxy.muteServer.Store(true)
+	_, err := client.SendReliable([]byte("hello"), "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectText(t, received, "hello")
+	time.Sleep(3 * options.AckTimeout)
+
+	// Retransmitted once resumed, the session remembers it was already delivered
+	proxy.drop(false)
+	proxy.muteServer.Store(false)
+	receive(t, connections)
+
+	eventually(t, func() bool {
+		client.reliable.mu.Lock()
+		defer client.reliable.mu.Unlock()
+
+		return len(client.reliable.pending) == 0
+	})
+
+	select {
+	case msg := <-received:
+		t.Fatalf("expected the retransmissions to be dropped as duplicates, got %q delivered again", msg)
+	case messageId := <-failed:
+		t.Fatalf("expected %q to be acknowledged", messageId)
+	case <-time.After(3 * options.AckTimeout):
+	}
+}
+
+func TestReliableStreamAcrossReconnect(t *testing.T) {
+	options := ReliableOptions{AckTimeout: 100 * time.Millisecond, MaxAttempts: 50}
+	server, proxy, _ := newTestServer(t, Server_Params{Reliable: options})
+
+	received := make(chan string, 16)
+	failed := make(chan string, 16)
+	connections := make(chan *Connection, 16)
+	server.OnConnect = func(connection *Connection) {
+		connection.OnReliableMessage = func(messageId string, msg []byte) { received <- string(msg) }
+		connection.OnDeliveryFailed = func(messageId string, msg []byte, err error) { failed <- messageId }
+		connections <- connection
+	}
+	closed := make(chan *Connection, 16)
+	server.OnClose = func(connection *Connection, info CloseInfo) { closed <- connection }
+
+	clientReceived := make(chan string, 16)
+	client := dialTestClient(t, proxy, WithReliableOptions(options))
+	client.OnReliableMessage = func(messageId string, msg []byte) { clientReceived <- string(msg) }
+	client.OnDeliveryFailed = func(messageId string, msg []byte, err error) { failed <- messageId }
+	first := receive(t, connections)
+
+	// Without a session, the stream still remembers that the message was delivered before the reconnection
+	proxy.muteServer.Store(true)
+	client.SendReliable([]byte("to the server"), "m1")
+	expectText(t, received, "to the server")
+	time.Sleep(3 * options.AckTimeout)
+
+	proxy.drop(true)
+	proxy.muteServer.Store(false)
+	if connection := receive(t, closed); connection != first {
+		t.Fatal("expected the first connection to close")
+	}
+
+	// Sent while the client is away, retransmitted once it reconnects
+	_, err := first.SendReliable([]byte("to the client"), "m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.restore()
+	second := receive(t, connections)
+	expectText(t, clientReceived, "to the client")
+
+	eventually(t, func() bool {
+		client.reliable.mu.Lock()
+		defer client.reliable.mu.Unlock()
+		second.reliable.mu.Lock()
+		defer second.reliable.mu.Unlock()
+
+		return len(client.reliable.pending) == 0 && len(second.reliable.pending) == 0
+	})
+
+	select {
+	case msg := <-received:
+		t.Fatalf("expected the retransmissions to be dropped as duplicates, got %q delivered again", msg)
+	case messageId := <-failed:
+		t.Fatalf("expected %q to be acknowledged", messageId)
+	case <-time.After(3 * options.AckTimeout):
+	}
+}
+
+func TestReliableStreamExpires(t *testing.T) {
+	var store reliableStreamStore
+	store.init(ReliableOptions{StreamTTL: 50 * time.Millisecond})
+
+	// Another principal can't take the stream over
+	alice := &Connection{principal: "alice", reliableStream: "stream"}
+	channel, resumed := store.attach(alice, "stream")
+	if resumed {
+		t.Fatal("expected a new stream")
+	}
+	if other, resumed := store.attach(&Connection{principal: "mallory"}, "stream"); resumed || other == channel {
+		t.Fatal("expected another principal to be given a new stream")
+	}
+
+	store.detach(alice)
+	time.Sleep(200 * time.Millisecond)
+
+	if _, resumed := store.attach(&Connection{principal: "alice"}, "stream"); resumed {
+		t.Fatal("expected the stream to expire")
+	}
+	if err := channel.send("m1", nil); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected the expired channel to be closed, got %v", err)
+	}
+}
+
+func TestReliableSkipsParsers(t *testing.T) {
+	options := ReliableOptions{AckTimeout: 100 * time.Millisecond}
+	server, proxy, _ := newTestServer(t, Server_Params{Reliable: options, Sessions: SessionOptions{Enabled: true}})
+
+	swallowed := make(chan []byte, 64)
+	received := make(chan string, 16)
+	connections := make(chan *Connection, 1)
+	server.OnConnect = func(connection *Connection) {
+		registerCatchAllParser(connection.GetParserRegistry(), swallowed)
+		connection.OnReliableMessage = func(messageId string, msg []byte) { received <- string(msg) }
+		connections <- connection
+	}
+
+	clientReceived := make(chan string, 16)
+	client := dialTestClient(t, proxy, WithSessionResumption(), WithReliableOptions(options))
+	registerCatchAllParser(client.GetParserRegistry(), swallowed)
+	client.OnReliableMessage = func(messageId string, msg []byte) { clientReceived <- string(msg) }
+	connection := receive(t, connections)
+
+	client.SendReliable([]byte("to the server"))
+	expectText(t, received, "to the server")
+	connection.SendReliable([]byte("to the client"))
+	expectText(t, clientReceived, "to the client")
+
+	// Both acknowledged
+	eventually(t, func() bool {
+		client.reliable.mu.Lock()
+		defer client.reliable.mu.Unlock()
+		connection.reliable.mu.Lock()
+		defer connection.reliable.mu.Unlock()
+
+		return len(client.reliable.pending) == 0 && len(connection.reliable.pending) == 0
+	})
+
+	select {
+	case msg := <-swallowed:
+		t.Fatalf("expected no frame to reach the parsers, got %q", msg)
+	default:
+	}
+}
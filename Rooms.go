@@ -0,0 +1,178 @@
+package gows
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// Named groups of connections, see 'Connection.Join()' and 'Server.BroadcastToRoom()'
+type connectionRooms struct {
+	mu sync.RWMutex
+	// Room -> its members
+	members map[string]map[*Connection]struct{}
+	// Connection -> the rooms it joined
+	joined map[*Connection]map[string]struct{}
+}
+
+func (rooms *connectionRooms) init() {
+	rooms.members = make(map[string]map[*Connection]struct{})
+	rooms.joined = make(map[*Connection]map[string]struct{})
+}
+
+// Returns false if 'connection' already was in 'room'
+func (rooms *connectionRooms) join(connection *Connection, room string) bool {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	_, exists := rooms.joined[connection][room]
+	if exists {
+		return false
+	}
+
+	if rooms.members[room] == nil {
+		rooms.members[room] = make(map[*Connection]struct{})
+	}
+	rooms.members[room][connection] = struct{}{}
+
+	if rooms.joined[connection] == nil {
+		rooms.joined[connection] = make(map[string]struct{})
+	}
+	rooms.joined[connection][room] = struct{}{}
+
+	return true
+}
+
+// Returns false if 'connection' wasn't in 'room'
+func (rooms *connectionRooms) leave(connection *Connection, room string) bool {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	_, exists := rooms.joined[connection][room]
+	if !exists {
+		return false
+	}
+
+	delete(rooms.members[room], connection)
+	if len(rooms.members[room]) == 0 {
+		delete(rooms.members, room)
+	}
+
+	delete(rooms.joined[connection], room)
+	if len(rooms.joined[connection]) == 0 {
+		delete(rooms.joined, connection)
+	}
+
+	return true
+}
+
+// Removes 'connection' from every room, returns the rooms it left
+func (rooms *connectionRooms) leaveAll(connection *Connection) (left []string) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	for room := range rooms.joined[connection] {
+		delete(rooms.members[room], connection)
+		if len(rooms.members[room]) == 0 {
+			delete(rooms.members, room)
+		}
+		left = append(left, room)
+	}
+	delete(rooms.joined, connection)
+
+	return left
+}
+
+// Hands the memberships of 'from' over to 'to', used when a session is resumed on a new connection
+func (rooms *connectionRooms) move(from *Connection, to *Connection) {
+	rooms.mu.Lock()
+	defer rooms.mu.Unlock()
+
+	for room := range rooms.joined[from] {
+		delete(rooms.members[room], from)
+		rooms.members[room][to] = struct{}{}
+	}
+
+	if joined, exists := rooms.joined[from]; exists {
+		rooms.joined[to] = joined
+		delete(rooms.joined, from)
+	}
+}
+
+func (rooms *connectionRooms) roomsOf(connection *Connection) []string {
+	rooms.mu.RLock()
+	defer rooms.mu.RUnlock()
+
+	return slices.Collect(maps.Keys(rooms.joined[connection]))
+}
+
+func (rooms *connectionRooms) membersOf(room string) []*Connection {
+	rooms.mu.RLock()
+	defer rooms.mu.RUnlock()
+
+	return slices.Collect(maps.Keys(rooms.members[room]))
+}
+
+//// Connection methods
+
+// Adds the connection to 'room', returns false if it already was a member
+//
+// Connections leave all their rooms once closed, unless their session can still be resumed (see 'Server_Params.Sessions')
+func (connection *Connection) Join(room string) bool {
+	joined := connection.parent.rooms.join(connection, room)
+	if joined {
+		connection.parent.presence.track(connection, presenceScope{room: room})
+	}
+
+	return joined
+}
+
+// Removes the connection from 'room', returns false if it wasn't a member
+func (connection *Connection) Leave(room string) bool {
+	left := connection.parent.rooms.leave(connection, room)
+	if left {
+		connection.parent.presence.untrack(connection, presenceScope{room: room})
+	}
+
+	return left
+}
+
+// Returns the rooms the connection is a member of, in no particular order
+func (connection *Connection) Rooms() []string {
+	return connection.parent.rooms.roomsOf(connection)
+}
+
+//// Server methods
+
+// Returns the members of 'room', in no particular order
+//
+// NOTE: Includes the connections of disconnected sessions that can still be resumed
+func (server *Server) RoomMembers(room string) []*Connection {
+	return server.rooms.membersOf(room)
+}
+
+// Same as 'Broadcast()', but only to the members of 'room'
+//
+// Members whose session is waiting to be resumed get the message once they reconnect. With a 'Server_Params.Broker', the members of the room on the other nodes get it too
+func (server *Server) BroadcastToRoom(room string, v interface{}) (failCount int, err error) {
+	preparedMessage, data, err := prepareBroadcast(v)
+	if err != nil {
+		return 0, err
+	}
+
+	failCount = server.broadcastLocalToRoom(room, preparedMessage, data)
+	return failCount, server.publish(room, data)
+}
+
+func (server *Server) broadcastLocalToRoom(room string, preparedMessage *ws.PreparedMessage, data []byte) (failCount int) {
+	for _, connection := range server.rooms.membersOf(room) {
+		err := connection.sendPrepared(preparedMessage, data)
+		if err != nil {
+			failCount++
+		}
+	}
+
+	return failCount
+}
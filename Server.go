@@ -5,13 +5,99 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/GTedZ/gows/broker"
+	"github.com/GTedZ/gows/websockets"
 	"github.com/gorilla/websocket"
 	jsoniter "github.com/json-iterator/go"
 )
 
 type Server_Params struct {
 	PrivateMessagePropertyName string
+
+	// Maximum number of simultaneous connections, excess upgrades are rejected with 503 Service Unavailable
+	//
+	// 0 means unlimited
+	MaxConnections int
+	// Maximum number of simultaneous connections per remote IP, excess upgrades are rejected with 429 Too Many Requests
+	//
+	// 0 means unlimited
+	MaxConnectionsPerIP int
+	// Maximum number of simultaneous connections per principal (see 'PrincipalResolver'), excess upgrades are rejected with 429 Too Many Requests
+	//
+	// 0 means unlimited
+	MaxConnectionsPerPrincipal int
+
+	// Headers carrying the client's IP when the server sits behind a proxy (e.g. "X-Forwarded-For", "X-Real-IP"), checked in order
+	//
+	// WARNING: Only set this behind a proxy, otherwise clients can spoof their IP
+	TrustedProxyHeaders []string
+	// Number of trusted proxies appending to list headers such as "X-Forwarded-For", the client's IP is read that many entries from the right
+	//
+	// 0 means 1
+	TrustedProxyHops int
+
+	// Used to identify the authenticated principal (user id, api key...) behind an upgrade request
+	//
+	// An empty principal is not subject to 'MaxConnectionsPerPrincipal'
+	PrincipalResolver func(r *http.Request) string
+
+	// Per-connection limit applied to plain (non-private) inbound messages
+	MessageRateLimit RateLimit
+	// Per-connection limit applied to inbound private requests
+	RequestRateLimit RateLimit
+
+	// Maximum size in bytes of an inbound message, 0 means unlimited
+	//
+	// A bigger message closes the connection with 1009 (Message Too Big) and emits 'ErrReadLimitExceeded' through 'OnError'
+	ReadLimit int64
+	// I/O buffer sizes in bytes, 0 uses the default size (4096)
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Time allowed for the upgrade handshake to complete, 0 means no timeout
+	HandshakeTimeout time.Duration
+
+	// permessage-deflate negotiation, disabled by default
+	Compression CompressionOptions
+
+	// Subprotocols supported by the server, in order of preference, see 'HandleSubprotocol()' to route them to different handlers
+	Subprotocols []string
+
+	// Inbound messages bigger than this amount of bytes are delivered through 'Connection.OnMessageStream' (when set), 0 uses STREAM_THRESHOLD_BYTES
+	//
+	// Like 'ReadLimit', it must be at least FILE_TRANSFER_MAX_FRAME_SIZE for connections to receive files
+	StreamThreshold int
+
+	// Lets clients created with 'WithSessionResumption()' resume their session after reconnecting: the messages sent meanwhile are replayed, and the new connection gets the previous one's id, 'Data' and rooms
+	//
+	// WARNING: The session token is all it takes to resume a session, so only enable this over TLS
+	Sessions SessionOptions
+
+	// Ack timeout, retransmission attempts, dedup window and stream TTL of the reliable messages, see 'Connection.SendReliable()'
+	Reliable ReliableOptions
+
+	// Fans 'Broadcast()' and 'BroadcastToRoom()' out to the other servers subscribed to the same channel, so that they reach the connections of every node
+	//
+	// See 'broker.NewMemory()' and 'broker.DialNATS()'. The subscription is made once the server starts listening
+	Broker broker.Broker
+	// Channel the broadcasts are published on, defaults to CLUSTER_CHANNEL
+	BrokerChannel string
+	// Identifies this server among the nodes, so that it skips its own broadcasts, defaults to a random id
+	NodeID string
+
+	// How long a principal stays present after its last connection closes, so that reconnecting within it doesn't emit a leave and a join, see 'Server.OnPresence'
+	//
+	// 0 uses PRESENCE_DEBOUNCE_SEC, a negative value emits leaves right away
+	PresenceDebounce time.Duration
+
+	// What happens to a connection once a panic in one of its callbacks has been recovered, see 'Server.OnPanic'
+	PanicAction PanicAction
+
+	// Generates the connection ids, defaults to 'NewUUIDv7Generator()'
+	//
+	// Use a 'NewSnowflakeGenerator()' with a distinct node id per instance to tell which server holds a connection from its id alone
+	IDGenerator IDGenerator
 }
 
 type Server struct {
@@ -19,15 +105,59 @@ type Server struct {
 	addr                       string
 	path                       string
 	privateMessagePropertyName string
-	nextConnectionId           int
-
+	idGenerator                IDGenerator
+
+	limiter             connectionLimiter
+	trustedProxyHeaders []string
+	trustedProxyHops    int
+	principalResolver   func(r *http.Request) string
+
+	messageRateLimit RateLimit
+	requestRateLimit RateLimit
+	readLimit        int64
+	socketOptions    websockets.SocketOptions
+
+	subprotocolHandlers map[string]SubprotocolHandlers
+	indexes             connectionIndexes
+	rooms               connectionRooms
+	sessions            sessionStore
+	reliableStreams     reliableStreamStore
+	presence            presenceTracker
+	middlewares         middlewareChain
+	panicAction         PanicAction
+	reliableOptions     ReliableOptions
+
+	nodeId             string
+	broker             broker.Broker
+	brokerChannel      string
+	brokerMu           sync.Mutex
+	brokerSubscription broker.Subscription
+	// Shared by every connection, so that uploads can be resumed on a new connection
+	incomingFiles *incomingFileTransfers
+
+	// The connection starts reading once this returns
 	OnConnect func(*Connection)
-	OnClose   func(connection *Connection, code int, reason string)
-
-	Connections struct {
-		Mu  sync.Mutex
-		Map map[int]*Connection
-	}
+	OnClose   func(connection *Connection, info CloseInfo)
+	// Called once a disconnected session can no longer be resumed, with its last connection, see 'Server_Params.Sessions'
+	//
+	// Until then, the connection is kept in its rooms and still gets broadcasts, replayed once the client resumes
+	OnSessionExpired func(connection *Connection)
+	// Called when a principal joins or leaves the server or a room, or when one of its connections changes, see 'Presence()' and 'Online()'
+	//
+	// Connections are grouped by principal (see 'Server_Params.PrincipalResolver'), so a principal joins with its first connection and leaves with its last one
+	//
+	// Events are emitted one at a time, in the order the changes happened
+	OnPresence func(event PresenceEvent)
+	// Called when a callback panics (OnConnect, OnMessage, OnRequest, the parsers, the middlewares...), the panic is recovered so that it doesn't crash the process, then 'Server_Params.PanicAction' is taken
+	//
+	// 'connection' is nil for the callbacks that aren't tied to one (e.g. OnPresence)
+	OnPanic func(connection *Connection, recovered interface{}, stack []byte)
+	// Called when an upgrade request is rejected because of a connection limit
+	OnRejected func(r *http.Request, reason RejectReason)
+	// Called when an inbound message or request exceeds the connection's rate limit, before the configured action is taken
+	OnRateLimited func(connection *Connection, isRequest bool)
+
+	Connections ConnectionRegistry
 }
 
 func (server *Server) init(addr string, path string, privateMessagePropertyName string) {
@@ -37,49 +167,159 @@ func (server *Server) init(addr string, path string, privateMessagePropertyName
 
 	server.SetCheckOrigin(nil)
 
-	server.Connections.Map = make(map[int]*Connection)
+	server.Connections.init()
+	server.subprotocolHandlers = make(map[string]SubprotocolHandlers)
+	server.indexes.init()
+	server.rooms.init()
+	server.middlewares.init()
+	server.incomingFiles = newIncomingFileTransfers()
 }
 
 func (server *Server) onConnect(w http.ResponseWriter, r *http.Request) {
+	remoteIP := resolveRemoteIP(r, server.trustedProxyHeaders, server.trustedProxyHops)
+
+	var principal string
+	if server.principalResolver != nil {
+		principal = server.principalResolver(r)
+	}
+
+	ok, reason := server.limiter.acquire(remoteIP, principal)
+	if !ok {
+		http.Error(w, reason.String(), reason.statusCode())
+
+		if server.OnRejected != nil {
+			server.OnRejected(r, reason)
+		}
+		return
+	}
+
 	conn, err := server.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		server.limiter.release(remoteIP, principal)
 		fmt.Println("Upgrade error:", err)
 		return
 	}
 
-	connectionId := server.nextConnectionId
-	server.nextConnectionId++
+	if server.readLimit > 0 {
+		conn.SetReadLimit(server.readLimit)
+	}
+
+	connectionId := server.idGenerator.NewID()
+
+	// Locked until the client has been synchronized
+	session, lastSequence, resumed := server.sessions.open(r.Header, remoteIP, principal)
+	var previous *Connection
+	if resumed {
+		previous = session.connection
+		connectionId = previous.GetId()
+	}
+
+	// Not reading yet, so that nothing can arrive, nor close it, before it is fully set up
+	connection := assignConnection(server, conn, r, server.privateMessagePropertyName, connectionId, remoteIP, principal)
+
+	// Retransmitted once the session (if any) has synchronized the client
+	var resend bool
+	if stream := r.Header.Get(STREAM_HEADER); stream != "" && len(stream) <= 64 {
+		connection.reliableStream = stream
+		connection.reliable, resend = server.reliableStreams.attach(connection, stream)
+	}
+
+	if session != nil {
+		if resumed {
+			connection.Data.restore(&previous.Data)
+			server.rooms.move(previous, connection)
+			server.presence.inherit(previous, connection)
+
+			if connection.reliableStream == "" {
+				connection.reliable = previous.reliable
+				connection.reliable.setPeer(connection)
+				resend = true
+			}
+		}
+
+		connection.session = session
+		connection.resumed = resumed
+		connection.resumeInfo = session.attach(connection, lastSequence, resumed)
+	}
+
+	if resend {
+		connection.reliable.resend()
+	}
 
-	connection := assignConnection(server, conn, r, server.privateMessagePropertyName, connectionId)
+	handlers := server.getSubprotocolHandlers(conn.Subprotocol())
+	connection.codec = handlers.Codec
+	if handlers.RegisterParsers != nil {
+		handlers.RegisterParsers(connection.GetParserRegistry())
+	}
 
 	server.addConnection(connection)
 
-	if server.OnConnect != nil {
-		server.OnConnect(connection)
+	if handlers.OnConnect != nil {
+		func() {
+			defer server.recoverPanic(connection)
+			handlers.OnConnect(connection)
+		}()
 	}
+
+	// Once OnConnect has set its metadata and rooms, so that they come with the join events. A resumed session is present again in the rooms it kept
+	scopes := []presenceScope{{online: true}}
+	for _, room := range server.rooms.roomsOf(connection) {
+		scopes = append(scopes, presenceScope{room: room})
+	}
+	server.presence.track(connection, scopes...)
+
+	// Only once OnConnect has set the callbacks, so that the first messages (e.g. a file offer resumed right away) reach them
+	connection.base.Start()
 }
 
 func (server *Server) addConnection(connection *Connection) {
-	server.Connections.Mu.Lock()
-	defer server.Connections.Mu.Unlock()
-
-	server.Connections.Map[connection.GetId()] = connection
+	server.Connections.add(connection)
+	server.indexes.addConnection(connection)
 }
 
 func (server *Server) removeConnection(connection *Connection) {
-	server.Connections.Mu.Lock()
-	defer server.Connections.Mu.Unlock()
-
-	delete(server.Connections.Map, connection.GetId())
+	server.Connections.remove(connection)
+	server.indexes.removeConnection(connection)
+	server.presence.untrackAll(connection)
 }
 
 //
 
-func (server *Server) onConnectionClose(connection *Connection, code int, reason string) {
+func (server *Server) onConnectionClose(connection *Connection, info CloseInfo) {
 	server.removeConnection(connection)
+	server.limiter.release(connection.remoteIP, connection.principal)
+
+	// A session keeps its rooms until it expires
+	if connection.session != nil {
+		connection.session.detach(connection)
+	} else {
+		server.rooms.leaveAll(connection)
+	}
 
 	if server.OnClose != nil {
-		server.OnClose(connection, code, reason)
+		server.OnClose(connection, info)
+	}
+}
+
+func (server *Server) onPresence(event PresenceEvent) {
+	defer server.recoverPanic(nil)
+
+	if server.OnPresence != nil {
+		server.OnPresence(event)
+	}
+}
+
+func (server *Server) onSessionExpired(connection *Connection) {
+	server.rooms.leaveAll(connection)
+	// A stream expires on its own
+	if connection.reliableStream == "" {
+		connection.reliable.close(ErrDisconnected)
+	}
+
+	defer server.recoverPanic(connection)
+
+	if server.OnSessionExpired != nil {
+		server.OnSessionExpired(connection)
 	}
 }
 
@@ -100,6 +340,11 @@ func (server *Server) SetCheckOrigin(checkOrigin func(r *http.Request) bool) {
 
 // This method WILL block until the server is terminated or an error occurs
 func (server *Server) ListenAndServe(port int) error {
+	err := server.subscribeBroker()
+	if err != nil {
+		return err
+	}
+
 	http.HandleFunc(server.path, server.onConnect)
 	fullAddr := fmt.Sprintf("%s:%d", server.addr, port)
 	return http.ListenAndServe(fullAddr, nil)
@@ -107,6 +352,11 @@ func (server *Server) ListenAndServe(port int) error {
 
 // This method WILL block until the server is terminated or an error occurs
 func (server *Server) ListenAndServeTLS(port int, certificate tls.Certificate) error {
+	err := server.subscribeBroker()
+	if err != nil {
+		return err
+	}
+
 	http.HandleFunc(server.path, server.onConnect)
 	fullAddr := fmt.Sprintf("%s:%d", server.addr, port)
 
@@ -122,6 +372,11 @@ func (server *Server) ListenAndServeTLS(port int, certificate tls.Certificate) e
 
 // This method WILL block until the server is terminated or an error occurs
 func (server *Server) ListenAndServeTLSWithFiles(port int, certFile, keyFile string) error {
+	err := server.subscribeBroker()
+	if err != nil {
+		return err
+	}
+
 	http.HandleFunc(server.path, server.onConnect)
 	fullAddr := fmt.Sprintf("%s:%d", server.addr, port)
 	return http.ListenAndServeTLS(fullAddr, certFile, keyFile, nil)
@@ -129,25 +384,46 @@ func (server *Server) ListenAndServeTLSWithFiles(port int, certFile, keyFile str
 
 // Broadcasts a message to all active connections to the server
 //
-// 'err' is returned only when preparing the message for broadcast goes wrong, meaning no connection was sent the message
+// 'err' is returned when preparing the message for broadcast goes wrong, meaning no connection was sent the message, or when publishing it to the other nodes fails (see 'Server_Params.Broker'), the local connections were then still sent the message
 //
-// Otherwise 'failCount' keeps track of how many connections failed to be sent the message
+// Otherwise 'failCount' keeps track of how many local connections failed to be sent the message
+//
+// NOTE: The message is compressed at most once, each connection is sent the compressed or uncompressed variant depending on what it negotiated
+//
+// Disconnected sessions waiting to be resumed get the message once they reconnect
 func (server *Server) Broadcast(v interface{}) (failCount int, err error) {
-	data, err := jsoniter.Marshal(v)
+	preparedMessage, data, err := prepareBroadcast(v)
 	if err != nil {
 		return 0, err
 	}
 
-	preparedMessage, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	failCount = server.broadcastLocal(preparedMessage, data)
+	return failCount, server.publish("", data)
+}
+
+func (server *Server) broadcastLocal(preparedMessage *websocket.PreparedMessage, data []byte) (failCount int) {
+	// Sent outside of the registry's lock, a slow connection never blocks connects and disconnects
+	for _, connection := range append(server.Connections.snapshot(), server.sessions.detached()...) {
+		err := connection.sendPrepared(preparedMessage, data)
+		if err != nil {
+			failCount++
+		}
+	}
+
+	return failCount
+}
+
+// Same as 'Broadcast()', but only to the connections for which 'predicate' returns true, see 'Find()'
+//
+// NOTE: Only reaches the local connections, the predicate can't be evaluated by the other nodes
+func (server *Server) BroadcastWhere(predicate func(connection *Connection) bool, v interface{}) (failCount int, err error) {
+	preparedMessage, data, err := prepareBroadcast(v)
 	if err != nil {
 		return 0, err
 	}
 
-	server.Connections.Mu.Lock()
-	defer server.Connections.Mu.Unlock()
-
-	for _, connection := range server.Connections.Map {
-		err := connection.SendPreparedMessage(preparedMessage)
+	for _, connection := range server.Find(predicate) {
+		err := connection.sendPrepared(preparedMessage, data)
 		if err != nil {
 			failCount++
 		}
@@ -156,14 +432,26 @@ func (server *Server) Broadcast(v interface{}) (failCount int, err error) {
 	return failCount, nil
 }
 
+// 'data' is kept by the sessions for replay
+func prepareBroadcast(v interface{}) (preparedMessage *websocket.PreparedMessage, data []byte, err error) {
+	data, err = jsoniter.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	preparedMessage, err = websocket.NewPreparedMessage(websocket.TextMessage, data)
+	return preparedMessage, data, err
+}
+
 ////
 
 func NewServer(addr string, path string, opt_params ...Server_Params) *Server {
 	var server Server
 
 	privateMessagePropertyName := "id"
+	var params Server_Params
 	if len(opt_params) != 0 {
-		params := opt_params[0]
+		params = opt_params[0]
 
 		if params.PrivateMessagePropertyName != "" {
 			privateMessagePropertyName = params.PrivateMessagePropertyName
@@ -172,5 +460,44 @@ func NewServer(addr string, path string, opt_params ...Server_Params) *Server {
 
 	server.init(addr, path, privateMessagePropertyName)
 
+	server.limiter.init(params.MaxConnections, params.MaxConnectionsPerIP, params.MaxConnectionsPerPrincipal)
+	server.trustedProxyHeaders = params.TrustedProxyHeaders
+	server.trustedProxyHops = params.TrustedProxyHops
+	server.principalResolver = params.PrincipalResolver
+	server.messageRateLimit = params.MessageRateLimit
+	server.requestRateLimit = params.RequestRateLimit
+
+	server.readLimit = params.ReadLimit
+	server.upgrader.ReadBufferSize = params.ReadBufferSize
+	server.upgrader.WriteBufferSize = params.WriteBufferSize
+	server.upgrader.HandshakeTimeout = params.HandshakeTimeout
+
+	server.upgrader.EnableCompression = params.Compression.Enabled
+	server.upgrader.Subprotocols = params.Subprotocols
+	server.socketOptions.Compression = params.Compression
+	server.socketOptions.StreamThreshold = params.StreamThreshold
+	checkFileTransferLimits(params.ReadLimit, params.StreamThreshold)
+
+	server.sessions.init(params.Sessions, server.onSessionExpired)
+	server.reliableOptions = params.Reliable
+	server.reliableStreams.init(params.Reliable)
+	server.presence.init(params.PresenceDebounce, server.onPresence)
+	server.panicAction = params.PanicAction
+
+	server.broker = params.Broker
+	server.brokerChannel = params.BrokerChannel
+	if server.brokerChannel == "" {
+		server.brokerChannel = CLUSTER_CHANNEL
+	}
+	server.nodeId = params.NodeID
+	if server.nodeId == "" {
+		server.nodeId = newTransferId()
+	}
+
+	server.idGenerator = params.IDGenerator
+	if server.idGenerator == nil {
+		server.idGenerator = NewUUIDv7Generator()
+	}
+
 	return &server
 }
@@ -0,0 +1,495 @@
+package gows
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// Handshake header carrying the token of the session to resume, "new" when the client has none yet
+	SESSION_HEADER = "Gows-Session"
+	// Handshake header carrying the sequence number of the last message the client received
+	SESSION_SEQUENCE_HEADER = "Gows-Session-Sequence"
+
+	// Default amount of messages kept per session for replay
+	SESSION_REPLAY_BUFFER_SIZE = 256
+	// Default time a disconnected session can be resumed for
+	SESSION_TTL_SEC = 2 * 60
+	// Default amount of sessions a single client can hold, see 'SessionOptions.MaxPerClient'
+	SESSION_MAX_PER_CLIENT = 16
+)
+
+// Session resumption settings, see 'Server_Params.Sessions'
+//
+// Only clients created with 'WithSessionResumption()' get a session
+type SessionOptions struct {
+	Enabled bool
+	// Amount of messages kept per session for replay, 0 uses SESSION_REPLAY_BUFFER_SIZE
+	ReplayBufferSize int
+	// How long a disconnected session can be resumed for, 0 uses SESSION_TTL_SEC
+	TTL time.Duration
+	// Amount of sessions a single principal (or IP for the clients without one) can hold, 0 uses SESSION_MAX_PER_CLIENT, negative means unlimited
+	//
+	// Opening one more ends its oldest disconnected session, or goes without a session if they are all connected
+	MaxPerClient int
+}
+
+// Describes a resumed session, see 'Connection.Resumed()' and 'Client.OnResume'
+type ResumeInfo struct {
+	// Missed messages that were sent again
+	Replayed int
+	// Missed messages that couldn't be sent again, because they were evicted from the replay buffer or can't be replayed (file transfer frames, prepared messages and streams)
+	Missed int
+}
+
+//// Frames
+
+// Every message the server sends within a session is numbered, implicitly: both sides count them, and the server sends a session frame to align the client's count
+//
+// A session frame is sent first on every connection (with the token), and again after replaying a message whenever the next one can't be replayed
+//
+// Session frames are binary messages starting with the magic followed by a JSON 'sessionFrame', they are not numbered themselves
+var sessionFrameMagic = []byte("GWSS")
+
+type sessionFrame struct {
+	// Only set on the first frame of a connection
+	Token string `json:"token,omitempty"`
+	// Sequence number of the last message sent before this frame
+	Sequence uint64 `json:"seq"`
+	Resumed  bool   `json:"resumed,omitempty"`
+	Replayed int    `json:"replayed,omitempty"`
+	Missed   int    `json:"missed,omitempty"`
+}
+
+func encodeSessionFrame(frame sessionFrame) []byte {
+	payload, _ := jsoniter.Marshal(frame)
+	return append(slices.Clone(sessionFrameMagic), payload...)
+}
+
+func decodeSessionFrame(messageType int, msg []byte) (frame sessionFrame, isSessionFrame bool) {
+	if messageType != ws.BinaryMessage || !bytes.HasPrefix(msg, sessionFrameMagic) {
+		return frame, false
+	}
+
+	err := jsoniter.Unmarshal(msg[len(sessionFrameMagic):], &frame)
+	return frame, err == nil
+}
+
+//// Server
+
+type sessionMessage struct {
+	sequence    uint64
+	messageType int
+	// nil for the messages that can't be replayed
+	data []byte
+}
+
+type session struct {
+	token string
+	store *sessionStore
+	// Of the connection that opened the session, only the same principal can resume it
+	principal string
+	owner     sessionOwner
+
+	mu sync.Mutex
+	// The latest connection of the session, kept once disconnected to resume from
+	connection *Connection
+	attached   bool
+	// Set when the server closes the connection itself, the session then ends along with it
+	ended   bool
+	expired bool
+
+	// Sequence number of the last message sent
+	sequence uint64
+	// The last messages sent, oldest first
+	buffer []sessionMessage
+
+	// Bumped every time the session is detached or resumed, so that stale expiry timers are ignored
+	generation int
+	expiry     *time.Timer
+}
+
+// The principal, or the IP when there is none
+type sessionOwner struct {
+	principal string
+	ip        string
+}
+
+type sessionStore struct {
+	options SessionOptions
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	// Sessions of each owner, oldest first
+	owners map[sessionOwner][]*session
+
+	// Called once a disconnected session can no longer be resumed, with its last connection
+	onExpire func(connection *Connection)
+}
+
+func (store *sessionStore) init(options SessionOptions, onExpire func(connection *Connection)) {
+	if options.ReplayBufferSize <= 0 {
+		options.ReplayBufferSize = SESSION_REPLAY_BUFFER_SIZE
+	}
+	if options.TTL <= 0 {
+		options.TTL = SESSION_TTL_SEC * time.Second
+	}
+	if options.MaxPerClient == 0 {
+		options.MaxPerClient = SESSION_MAX_PER_CLIENT
+	}
+
+	store.options = options
+	store.sessions = make(map[string]*session)
+	store.owners = make(map[sessionOwner][]*session)
+	store.onExpire = onExpire
+}
+
+// Returns the session to resume if the handshake presents a valid one opened by the same principal, or a new session if the client asked for one, nil otherwise
+//
+// WARNING: The session is returned locked, so that nothing gets sent before 'attach()' has synchronized the client
+func (store *sessionStore) open(header http.Header, remoteIP string, principal string) (session *session, lastSequence uint64, resumed bool) {
+	token := header.Get(SESSION_HEADER)
+	if !store.options.Enabled || token == "" {
+		return nil, 0, false
+	}
+
+	store.mu.Lock()
+	session = store.sessions[token]
+	store.mu.Unlock()
+
+	if session != nil {
+		sequence, err := strconv.ParseUint(header.Get(SESSION_SEQUENCE_HEADER), 10, 64)
+
+		session.mu.Lock()
+		if err == nil && !session.expired && !session.ended && session.principal == principal {
+			session.generation++
+			if session.expiry != nil {
+				session.expiry.Stop()
+			}
+			return session, sequence, true
+		}
+		session.mu.Unlock()
+	}
+
+	owner := sessionOwner{principal: principal}
+	if principal == "" {
+		owner.ip = remoteIP
+	}
+	if !store.makeRoom(owner) {
+		return nil, 0, false
+	}
+
+	session = newSession(store, principal)
+	session.owner = owner
+
+	store.mu.Lock()
+	store.sessions[session.token] = session
+	store.owners[owner] = append(store.owners[owner], session)
+	store.mu.Unlock()
+
+	session.mu.Lock()
+	return session, 0, false
+}
+
+func newSession(store *sessionStore, principal string) *session {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	return &session{token: hex.EncodeToString(token), store: store, principal: principal}
+}
+
+// Returns the last connection of every session waiting to be resumed
+func (store *sessionStore) detached() (connections []*Connection) {
+	store.mu.Lock()
+	sessions := make([]*session, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		sessions = append(sessions, session)
+	}
+	store.mu.Unlock()
+
+	for _, session := range sessions {
+		session.mu.Lock()
+		if !session.attached && !session.expired && session.connection != nil {
+			connections = append(connections, session.connection)
+		}
+		session.mu.Unlock()
+	}
+
+	return connections
+}
+
+// Ends the oldest disconnected sessions of 'owner' until it can open one more, returns false if too many of them are connected
+func (store *sessionStore) makeRoom(owner sessionOwner) bool {
+	if store.options.MaxPerClient < 0 {
+		return true
+	}
+
+	store.mu.Lock()
+	owned := slices.Clone(store.owners[owner])
+	store.mu.Unlock()
+
+	excess := len(owned) - store.options.MaxPerClient + 1
+	for _, session := range owned {
+		if excess <= 0 {
+			break
+		}
+
+		session.mu.Lock()
+		if session.attached || session.expired {
+			session.mu.Unlock()
+			continue
+		}
+		store.drop(session)
+		excess--
+	}
+
+	return excess <= 0
+}
+
+func (store *sessionStore) expire(session *session, generation int) {
+	session.mu.Lock()
+	if session.generation != generation {
+		session.mu.Unlock()
+		return
+	}
+
+	store.drop(session)
+}
+
+// Ends a disconnected session for good
+//
+// Must be called with the session locked, unlocks it
+func (store *sessionStore) drop(session *session) {
+	session.expired = true
+	session.buffer = nil
+	if session.expiry != nil {
+		session.expiry.Stop()
+	}
+	connection := session.connection
+	session.mu.Unlock()
+
+	store.mu.Lock()
+	delete(store.sessions, session.token)
+	owned := store.owners[session.owner]
+	if index := slices.Index(owned, session); index != -1 {
+		owned = slices.Delete(owned, index, index+1)
+	}
+	if len(owned) == 0 {
+		delete(store.owners, session.owner)
+	} else {
+		store.owners[session.owner] = owned
+	}
+	store.mu.Unlock()
+
+	if store.onExpire != nil {
+		store.onExpire(connection)
+	}
+}
+
+// Makes 'connection' the session's connection, then synchronizes the client and replays the messages it missed
+//
+// Must be called with the session locked (see 'open()'), unlocks it
+func (session *session) attach(connection *Connection, lastSequence uint64, resumed bool) (info ResumeInfo) {
+	defer session.mu.Unlock()
+
+	previous, wasAttached := session.connection, session.attached
+	session.connection = connection
+	session.attached = true
+
+	if wasAttached {
+		// The client reconnected before the previous connection was noticed as dropped
+		go previous.base.CloseWithCode(ws.CloseNormalClosure, "Session resumed on another connection")
+	}
+
+	if !resumed {
+		connection.base.SendBinary(encodeSessionFrame(sessionFrame{Token: session.token, Sequence: session.sequence}))
+		return info
+	}
+
+	lastSequence = min(lastSequence, session.sequence)
+
+	var replay []sessionMessage
+	for _, message := range session.buffer {
+		if message.sequence > lastSequence && message.data != nil {
+			replay = append(replay, message)
+		}
+	}
+
+	info.Replayed = len(replay)
+	info.Missed = int(session.sequence-lastSequence) - len(replay)
+
+	err := connection.base.SendBinary(encodeSessionFrame(sessionFrame{Token: session.token, Sequence: lastSequence, Resumed: true, Replayed: info.Replayed, Missed: info.Missed}))
+
+	// The messages that can't be replayed are skipped by re-aligning the client's count
+	sequence := lastSequence
+	for _, message := range replay {
+		if err != nil {
+			return info
+		}
+
+		if message.sequence != sequence+1 {
+			err = connection.base.SendBinary(encodeSessionFrame(sessionFrame{Sequence: message.sequence - 1}))
+			if err != nil {
+				return info
+			}
+		}
+
+		if message.messageType == ws.BinaryMessage {
+			err = connection.base.SendBinary(message.data)
+		} else {
+			err = connection.base.SendText(string(message.data))
+		}
+		sequence = message.sequence
+	}
+
+	if err == nil && sequence != session.sequence {
+		connection.base.SendBinary(encodeSessionFrame(sessionFrame{Sequence: session.sequence}))
+	}
+
+	return info
+}
+
+// Numbers the message and keeps it for replay (when 'replayable'), then sends it through the session's current connection if any
+//
+// Messages that can't be replayed are only sent if 'connection' still is the session's current connection
+func (session *session) send(connection *Connection, messageType int, data []byte, replayable bool, send func(target *Connection) error) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.expired {
+		return ErrSocketClosed
+	}
+	if !replayable && (!session.attached || session.connection != connection) {
+		return ErrSocketClosed
+	}
+
+	session.sequence++
+
+	// Not copied, see 'Connection.sequenced()'
+	message := sessionMessage{sequence: session.sequence, messageType: messageType}
+	if replayable {
+		message.data = data
+	}
+
+	session.buffer = append(session.buffer, message)
+	if len(session.buffer) > session.store.options.ReplayBufferSize {
+		session.buffer = slices.Delete(session.buffer, 0, 1)
+	}
+
+	if !session.attached {
+		return nil
+	}
+
+	return send(session.connection)
+}
+
+// Called once 'connection' has been closed, the session then waits to be resumed
+func (session *session) detach(connection *Connection) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.connection != connection || !session.attached {
+		return
+	}
+	session.attached = false
+
+	ttl := session.store.options.TTL
+	if session.ended {
+		ttl = 0
+	}
+
+	session.generation++
+	generation := session.generation
+	session.expiry = time.AfterFunc(ttl, func() {
+		session.store.expire(session, generation)
+	})
+}
+
+// Called when the server closes 'connection' itself, the session can't be resumed afterwards
+func (session *session) end(connection *Connection) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.connection == connection {
+		session.ended = true
+	}
+}
+
+//// Client
+
+// Tracks the session of a Client created with 'WithSessionResumption()'
+type clientSession struct {
+	client *Client
+
+	mu    sync.Mutex
+	token string
+	// Sequence number of the last message received
+	sequence uint64
+}
+
+// Adds the session headers to the ones returned by 'provider' (if any)
+func (session *clientSession) headerProvider(provider func(ctx context.Context) (http.Header, error)) func(ctx context.Context) (http.Header, error) {
+	return func(ctx context.Context) (http.Header, error) {
+		header := http.Header{}
+		if provider != nil {
+			provided, err := provider(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if provided != nil {
+				header = provided.Clone()
+			}
+		}
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		token := session.token
+		if token == "" {
+			token = "new"
+		}
+
+		header.Set(SESSION_HEADER, token)
+		header.Set(SESSION_SEQUENCE_HEADER, strconv.FormatUint(session.sequence, 10))
+
+		return header, nil
+	}
+}
+
+// Sees every inbound message before anything else, see 'SocketOptions.OnReceive'
+func (session *clientSession) onReceive(messageType int, msg []byte) {
+	frame, isSessionFrame := decodeSessionFrame(messageType, msg)
+
+	session.mu.Lock()
+	if !isSessionFrame {
+		session.sequence++
+		session.mu.Unlock()
+		return
+	}
+
+	session.sequence = frame.Sequence
+	if frame.Token == "" {
+		session.mu.Unlock()
+		return
+	}
+
+	lost := session.token != "" && !frame.Resumed
+	session.token = frame.Token
+	session.mu.Unlock()
+
+	if frame.Resumed {
+		session.client.onResume(ResumeInfo{Replayed: frame.Replayed, Missed: frame.Missed})
+	} else if lost {
+		session.client.onSessionLost()
+	}
+}
@@ -0,0 +1,338 @@
+package gows
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//// Test helpers
+
+// Sits between the clients and the server, so that tests can drop connections the way a network would
+type testProxy struct {
+	t        *testing.T
+	listener net.Listener
+	target   string
+
+	mu     sync.Mutex
+	pairs  [][2]net.Conn
+	refuse bool
+	// Drops everything the server sends while set
+	muteServer atomic.Bool
+}
+
+func newTestProxy(t *testing.T, target string) *testProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &testProxy{t: t, listener: listener, target: target}
+	go proxy.accept()
+	t.Cleanup(func() {
+		listener.Close()
+		proxy.drop(false)
+	})
+
+	return proxy
+}
+
+func (proxy *testProxy) URL() string {
+	return "ws://" + proxy.listener.Addr().String() + "/"
+}
+
+func (proxy *testProxy) accept() {
+	for {
+		clientConn, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		proxy.mu.Lock()
+		refuse := proxy.refuse
+		proxy.mu.Unlock()
+		if refuse {
+			clientConn.Close()
+			continue
+		}
+
+		serverConn, err := net.Dial("tcp", proxy.target)
+		if err != nil {
+			clientConn.Close()
+			continue
+		}
+
+		proxy.mu.Lock()
+		proxy.pairs = append(proxy.pairs, [2]net.Conn{clientConn, serverConn})
+		proxy.mu.Unlock()
+
+		go func() {
+			io.Copy(serverConn, clientConn)
+			serverConn.Close()
+		}()
+		go func() {
+			buffer := make([]byte, 32*1024)
+			for {
+				n, err := serverConn.Read(buffer)
+				if err != nil {
+					clientConn.Close()
+					return
+				}
+				if !proxy.muteServer.Load() {
+					clientConn.Write(buffer[:n])
+				}
+			}
+		}()
+	}
+}
+
+// Closes every connection going through the proxy, new ones are refused until 'restore()' when 'refuse' is set
+func (proxy *testProxy) drop(refuse bool) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.refuse = refuse
+	for _, pair := range proxy.pairs {
+		pair[0].Close()
+		pair[1].Close()
+	}
+	proxy.pairs = nil
+}
+
+func (proxy *testProxy) restore() {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.refuse = false
+}
+
+// Serves 'server' on a random port, behind a proxy, its connections are sent to the returned channel once connected
+func newTestServer(t *testing.T, params Server_Params) (*Server, *testProxy, <-chan *Connection) {
+	server := NewServer("127.0.0.1", "/", params)
+
+	connections := make(chan *Connection, 16)
+	server.OnConnect = func(connection *Connection) {
+		connections <- connection
+	}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(server.onConnect))
+	t.Cleanup(httpServer.Close)
+
+	return server, newTestProxy(t, httpServer.Listener.Addr().String()), connections
+}
+
+func dialTestClient(t *testing.T, proxy *testProxy, options ...ClientOption) *Client {
+	t.Helper()
+
+	client, err := NewClient(proxy.URL(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	return client
+}
+
+func receive[T any](t *testing.T, values <-chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	panic("unreachable")
+}
+
+func expectText(t *testing.T, received <-chan string, expected ...string) {
+	t.Helper()
+
+	for _, text := range expected {
+		if got := receive(t, received); got != text {
+			t.Fatalf("expected %q, got %q", text, got)
+		}
+	}
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (session *session) isAttached() bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.attached
+}
+
+//// Resumption
+
+// Drops the client's connection and sends 'missed' while it is away, then lets it resume
+func resumeAfterOutage(t *testing.T, proxy *testProxy, connections <-chan *Connection, connection *Connection, missed ...string) *Connection {
+	t.Helper()
+
+	proxy.drop(true)
+	eventually(t, func() bool { return !connection.session.isAttached() })
+
+	for _, text := range missed {
+		err := connection.SendText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy.restore()
+	return receive(t, connections)
+}
+
+func TestSessionResumeReplaysMissedMessages(t *testing.T) {
+	_, proxy, connections := newTestServer(t, Server_Params{Sessions: SessionOptions{Enabled: true}})
+
+	received := make(chan string, 16)
+	resumes := make(chan ResumeInfo, 1)
+	client := dialTestClient(t, proxy, WithSessionResumption())
+	client.OnMessage = func(messageType int, msg []byte) { received <- string(msg) }
+	client.OnResume = func(info ResumeInfo) { resumes <- info }
+
+	first := receive(t, connections)
+	first.Data.SetString("user", "alice")
+	first.SendText("before")
+	expectText(t, received, "before")
+
+	second := resumeAfterOutage(t, proxy, connections, first, "missed 1", "missed 2")
+
+	info, resumed := second.Resumed()
+	if !resumed || info != (ResumeInfo{Replayed: 2}) {
+		t.Fatalf("expected the session to be resumed with 2 replayed messages, got %+v (resumed %v)", info, resumed)
+	}
+	if second.GetId() != first.GetId() {
+		t.Fatalf("expected the connection id %q to be kept, got %q", first.GetId(), second.GetId())
+	}
+	if user, _ := second.Data.GetString("user"); user != "alice" {
+		t.Fatalf("expected the connection's data to be kept, got %v", user)
+	}
+
+	if clientInfo := receive(t, resumes); clientInfo != info {
+		t.Fatalf("expected the client to be told %+v, got %+v", info, clientInfo)
+	}
+	expectText(t, received, "missed 1", "missed 2")
+
+	second.SendText("after")
+	expectText(t, received, "after")
+}
+
+func TestSessionResumeReportsEvictedMessages(t *testing.T) {
+	_, proxy, connections := newTestServer(t, Server_Params{Sessions: SessionOptions{Enabled: true, ReplayBufferSize: 2}})
+
+	received := make(chan string, 16)
+	resumes := make(chan ResumeInfo, 1)
+	client := dialTestClient(t, proxy, WithSessionResumption())
+	client.OnMessage = func(messageType int, msg []byte) { received <- string(msg) }
+	client.OnResume = func(info ResumeInfo) { resumes <- info }
+
+	first := receive(t, connections)
+	second := resumeAfterOutage(t, proxy, connections, first, "missed 1", "missed 2", "missed 3", "missed 4")
+
+	expected := ResumeInfo{Replayed: 2, Missed: 2}
+	if info, _ := second.Resumed(); info != expected {
+		t.Fatalf("expected %+v, got %+v", expected, info)
+	}
+	if info := receive(t, resumes); info != expected {
+		t.Fatalf("expected the client to be told %+v, got %+v", expected, info)
+	}
+	expectText(t, received, "missed 3", "missed 4")
+
+	// The client's count was re-aligned, the next messages still resume correctly
+	third := resumeAfterOutage(t, proxy, connections, second, "missed 5")
+	if info, _ := third.Resumed(); info != (ResumeInfo{Replayed: 1}) {
+		t.Fatalf("expected a single replayed message, got %+v", info)
+	}
+	expectText(t, received, "missed 5")
+}
+
+func TestSessionResumeRequiresSamePrincipal(t *testing.T) {
+	var store sessionStore
+	store.init(SessionOptions{Enabled: true}, nil)
+
+	header := http.Header{}
+	header.Set(SESSION_HEADER, "new")
+	opened, _, _ := store.open(header, "10.0.0.1", "alice")
+	opened.mu.Unlock()
+
+	header.Set(SESSION_HEADER, opened.token)
+	header.Set(SESSION_SEQUENCE_HEADER, "0")
+
+	session, _, resumed := store.open(header, "10.0.0.1", "mallory")
+	session.mu.Unlock()
+	if resumed || session == opened {
+		t.Fatal("expected another principal to be given a new session")
+	}
+
+	session, _, resumed = store.open(header, "10.0.0.2", "alice")
+	session.mu.Unlock()
+	if !resumed || session != opened {
+		t.Fatal("expected the same principal to resume its session")
+	}
+}
+
+//// Eviction
+
+func TestSessionEviction(t *testing.T) {
+	server, proxy, connections := newTestServer(t, Server_Params{Sessions: SessionOptions{Enabled: true, MaxPerClient: 2}})
+
+	expired := make(chan *Connection, 16)
+	server.OnSessionExpired = func(connection *Connection) { expired <- connection }
+
+	// Every client comes from the same IP, without a principal
+	var closed []*Connection
+	for range 3 {
+		client := dialTestClient(t, proxy, WithSessionResumption())
+		connection := receive(t, connections)
+		if connection.session == nil {
+			t.Fatal("expected a session")
+		}
+
+		client.Close()
+		eventually(t, func() bool { return !connection.session.isAttached() })
+		closed = append(closed, connection)
+	}
+
+	// Opening the third one ended the oldest disconnected one
+	if connection := receive(t, expired); connection != closed[0] {
+		t.Fatalf("expected the oldest session to expire, got the one of %s", connection.GetId())
+	}
+	select {
+	case connection := <-expired:
+		t.Fatalf("expected a single session to expire, got the one of %s", connection.GetId())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once every session is connected, the next client goes without one
+	dialTestClient(t, proxy, WithSessionResumption())
+	dialTestClient(t, proxy, WithSessionResumption())
+	for range 2 {
+		if receive(t, connections).session == nil {
+			t.Fatal("expected a session")
+		}
+	}
+
+	dialTestClient(t, proxy, WithSessionResumption())
+	if receive(t, connections).session != nil {
+		t.Fatal("expected no session once every session of the client is connected")
+	}
+}
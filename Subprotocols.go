@@ -0,0 +1,65 @@
+package gows
+
+import (
+	"slices"
+
+	"github.com/GTedZ/gows/parser"
+	ws "github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Encodes and decodes the messages of a connection, see 'Connection.Send()' and 'Connection.Unmarshal()'
+type Codec interface {
+	// Returns the encoded message along with the websocket message type it should be sent as
+	Marshal(v interface{}) (messageType int, data []byte, err error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The default codec, encodes messages as JSON text messages
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) (messageType int, data []byte, err error) {
+	data, err = jsoniter.Marshal(v)
+	return ws.TextMessage, data, err
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return jsoniter.Unmarshal(data, v)
+}
+
+// Set of handlers used for the connections that negotiated a given subprotocol
+type SubprotocolHandlers struct {
+	// Called instead of the server's 'OnConnect'
+	OnConnect func(*Connection)
+	// Called with each new connection's parser registry, before 'OnConnect'
+	RegisterParsers func(registry *parser.MessageParsers_Registry)
+	// Defaults to 'JSONCodec'
+	Codec Codec
+}
+
+// Routes the connections negotiating 'subprotocol' to the given handlers
+//
+// The subprotocol is added to the ones supported by the server if it wasn't already part of 'Server_Params.Subprotocols'
+//
+// NOTE: Must be called before the server starts listening
+func (server *Server) HandleSubprotocol(subprotocol string, handlers SubprotocolHandlers) {
+	server.subprotocolHandlers[subprotocol] = handlers
+
+	if !slices.Contains(server.upgrader.Subprotocols, subprotocol) {
+		server.upgrader.Subprotocols = append(server.upgrader.Subprotocols, subprotocol)
+	}
+}
+
+// Returns the handlers registered for 'subprotocol', falling back to the server's own
+func (server *Server) getSubprotocolHandlers(subprotocol string) SubprotocolHandlers {
+	handlers, exists := server.subprotocolHandlers[subprotocol]
+	if !exists {
+		handlers = SubprotocolHandlers{OnConnect: server.OnConnect}
+	}
+
+	if handlers.Codec == nil {
+		handlers.Codec = JSONCodec{}
+	}
+
+	return handlers
+}
@@ -0,0 +1,26 @@
+package broker
+
+import "errors"
+
+// Returned when publishing or subscribing through a broker that has been closed
+var ErrClosed = errors.New("broker has been closed")
+
+// Returned when publishing while the broker is disconnected from its server, the message is dropped
+var ErrDisconnected = errors.New("broker is disconnected")
+
+// Fans messages out to every subscriber of a channel, possibly across processes, see 'Server_Params.Broker'
+//
+// NOTE: Must be safe for concurrent use
+type Broker interface {
+	// Sends 'data' to every subscriber of 'channel', including the ones of this broker
+	Publish(channel string, data []byte) error
+	// 'handler' is called for every message published on 'channel', one at a time and in the order they were received
+	//
+	// 'data' must not be kept after 'handler' returns
+	Subscribe(channel string, handler func(data []byte)) (Subscription, error)
+	Close() error
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
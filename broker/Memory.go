@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"slices"
+	"sync"
+)
+
+// In-process broker, share a single one between the servers of the same process (mostly useful for testing)
+//
+// Handlers are called synchronously by 'Publish()', so the messages of a single publisher are delivered in order
+type Memory struct {
+	mu            sync.RWMutex
+	subscriptions map[string]map[*memorySubscription]struct{}
+	closed        bool
+}
+
+type memorySubscription struct {
+	broker  *Memory
+	channel string
+	handler func(data []byte)
+}
+
+func NewMemory() *Memory {
+	return &Memory{subscriptions: make(map[string]map[*memorySubscription]struct{})}
+}
+
+func (broker *Memory) Publish(channel string, data []byte) error {
+	broker.mu.RLock()
+	if broker.closed {
+		broker.mu.RUnlock()
+		return ErrClosed
+	}
+	subscriptions := make([]*memorySubscription, 0, len(broker.subscriptions[channel]))
+	for subscription := range broker.subscriptions[channel] {
+		subscriptions = append(subscriptions, subscription)
+	}
+	broker.mu.RUnlock()
+
+	// Handlers get their own copy, as they would over the network
+	for _, subscription := range subscriptions {
+		subscription.handler(slices.Clone(data))
+	}
+
+	return nil
+}
+
+func (broker *Memory) Subscribe(channel string, handler func(data []byte)) (Subscription, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.closed {
+		return nil, ErrClosed
+	}
+
+	subscription := &memorySubscription{broker: broker, channel: channel, handler: handler}
+	if broker.subscriptions[channel] == nil {
+		broker.subscriptions[channel] = make(map[*memorySubscription]struct{})
+	}
+	broker.subscriptions[channel][subscription] = struct{}{}
+
+	return subscription, nil
+}
+
+// Drops every subscription
+func (broker *Memory) Close() error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	broker.closed = true
+	broker.subscriptions = make(map[string]map[*memorySubscription]struct{})
+
+	return nil
+}
+
+func (subscription *memorySubscription) Unsubscribe() error {
+	broker := subscription.broker
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	delete(broker.subscriptions[subscription.channel], subscription)
+	if len(broker.subscriptions[subscription.channel]) == 0 {
+		delete(broker.subscriptions, subscription.channel)
+	}
+
+	return nil
+}
@@ -0,0 +1,443 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//// Fake NATS server
+
+// Speaks the subset of the NATS protocol used by the NATS broker, subjects are matched exactly (no wildcards)
+type fakeNATSServer struct {
+	t          *testing.T
+	listener   net.Listener
+	maxPayload int
+
+	mu    sync.Mutex
+	conns map[*fakeNATSConn]struct{}
+	// Incremented on every SUB received, see 'waitSubscriptions()'
+	subscribed int
+}
+
+type fakeNATSConn struct {
+	conn net.Conn
+
+	writeMu       sync.Mutex
+	subscriptions map[string]string // sid -> subject
+}
+
+func newFakeNATSServer(t *testing.T, maxPayload int) *fakeNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeNATSServer{
+		t:          t,
+		listener:   listener,
+		maxPayload: maxPayload,
+		conns:      make(map[*fakeNATSConn]struct{}),
+	}
+	go server.accept()
+	t.Cleanup(func() {
+		listener.Close()
+		server.dropConnections()
+	})
+
+	return server
+}
+
+func (server *fakeNATSServer) address() string {
+	return "nats://" + server.listener.Addr().String()
+}
+
+func (server *fakeNATSServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		fakeConn := &fakeNATSConn{conn: conn, subscriptions: make(map[string]string)}
+		server.mu.Lock()
+		server.conns[fakeConn] = struct{}{}
+		server.mu.Unlock()
+
+		go server.serve(fakeConn)
+	}
+}
+
+func (server *fakeNATSServer) serve(fakeConn *fakeNATSConn) {
+	defer func() {
+		fakeConn.conn.Close()
+		server.mu.Lock()
+		delete(server.conns, fakeConn)
+		server.mu.Unlock()
+	}()
+
+	info := `{"server_id":"fake","version":"2.10.0","proto":1}`
+	if server.maxPayload != 0 {
+		info = fmt.Sprintf(`{"server_id":"fake","version":"2.10.0","proto":1,"max_payload":%d}`, server.maxPayload)
+	}
+	fakeConn.write("INFO " + info + "\r\n")
+
+	reader := bufio.NewReader(fakeConn.conn)
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CONNECT":
+		case "PING":
+			fakeConn.write("PONG\r\n")
+		case "SUB":
+			server.mu.Lock()
+			fakeConn.subscriptions[fields[2]] = fields[1]
+			server.subscribed++
+			server.mu.Unlock()
+		case "UNSUB":
+			server.mu.Lock()
+			delete(fakeConn.subscriptions, fields[1])
+			server.mu.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			_, err = io.ReadFull(reader, payload)
+			if err != nil {
+				return
+			}
+			server.publish(fields[1], payload[:size])
+		default:
+			fakeConn.write("-ERR 'Unknown Protocol Operation'\r\n")
+		}
+	}
+}
+
+func (server *fakeNATSServer) publish(subject string, payload []byte) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for fakeConn := range server.conns {
+		for sid, subscribedSubject := range fakeConn.subscriptions {
+			if subscribedSubject == subject {
+				fakeConn.write(fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload))
+			}
+		}
+	}
+}
+
+// Sends 'frame' as is to every connection
+func (server *fakeNATSServer) sendRaw(frame string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for fakeConn := range server.conns {
+		fakeConn.write(frame)
+	}
+}
+
+func (server *fakeNATSServer) dropConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for fakeConn := range server.conns {
+		fakeConn.conn.Close()
+	}
+}
+
+// Waits until 'count' SUBs were received since the server started
+func (server *fakeNATSServer) waitSubscriptions(count int) {
+	server.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		server.mu.Lock()
+		subscribed := server.subscribed
+		server.mu.Unlock()
+
+		if subscribed >= count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	server.t.Fatalf("expected %d subscriptions on the NATS server", count)
+}
+
+func (fakeConn *fakeNATSConn) write(frame string) {
+	fakeConn.writeMu.Lock()
+	defer fakeConn.writeMu.Unlock()
+
+	fakeConn.conn.Write([]byte(frame))
+}
+
+//// Helpers
+
+func dialTestNATS(t *testing.T, server *fakeNATSServer, options NATSOptions) *NATS {
+	t.Helper()
+
+	if options.ReconnectWait == 0 {
+		options.ReconnectWait = 10 * time.Millisecond
+	}
+
+	broker, err := DialNATS(server.address(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func subscribeTestNATS(t *testing.T, broker *NATS, channel string) (Subscription, <-chan string) {
+	t.Helper()
+
+	received := make(chan string, 16)
+	subscription, err := broker.Subscribe(channel, func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return subscription, received
+}
+
+func expectMessage(t *testing.T, received <-chan string, expected string) {
+	t.Helper()
+
+	select {
+	case data := <-received:
+		if data != expected {
+			t.Fatalf("expected %q, got %q", expected, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %q, got nothing", expected)
+	}
+}
+
+func expectNoMessage(t *testing.T, received <-chan string) {
+	t.Helper()
+
+	select {
+	case data := <-received:
+		t.Fatalf("expected nothing, got %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+//// Tests
+
+func TestNATSPublishSubscribe(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+	publisher := dialTestNATS(t, server, NATSOptions{})
+	subscriber := dialTestNATS(t, server, NATSOptions{})
+
+	_, received := subscribeTestNATS(t, subscriber, "room.1")
+	_, other := subscribeTestNATS(t, subscriber, "room.2")
+	server.waitSubscriptions(2)
+
+	for _, data := range []string{"first", "", "third\r\nwith a line break"} {
+		err := publisher.Publish("room.1", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectMessage(t, received, "first")
+	expectMessage(t, received, "")
+	expectMessage(t, received, "third\r\nwith a line break")
+	expectNoMessage(t, other)
+}
+
+func TestNATSUnsubscribe(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+	broker := dialTestNATS(t, server, NATSOptions{})
+
+	subscription, received := subscribeTestNATS(t, broker, "room")
+	server.waitSubscriptions(1)
+
+	broker.Publish("room", []byte("before"))
+	expectMessage(t, received, "before")
+
+	err := subscription.Unsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("room", []byte("after"))
+	expectNoMessage(t, received)
+}
+
+func TestNATSInvalidChannel(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+	broker := dialTestNATS(t, server, NATSOptions{})
+
+	if broker.Publish("a b", nil) == nil {
+		t.Fatal("expected publishing on a channel with whitespace to fail")
+	}
+	if _, err := broker.Subscribe("", func([]byte) {}); err == nil {
+		t.Fatal("expected subscribing to an empty channel to fail")
+	}
+}
+
+func TestNATSReconnect(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+
+	errs := make(chan error, 16)
+	broker := dialTestNATS(t, server, NATSOptions{
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	_, received := subscribeTestNATS(t, broker, "room")
+	server.waitSubscriptions(1)
+
+	server.dropConnections()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the dropped connection to be reported")
+	}
+
+	// Restored once reconnected
+	server.waitSubscriptions(2)
+
+	publisher := dialTestNATS(t, server, NATSOptions{})
+	err := publisher.Publish("room", []byte("after reconnecting"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, received, "after reconnecting")
+
+	// A subscription made while disconnected is sent once reconnected
+	server.dropConnections()
+	_, late := subscribeTestNATS(t, broker, "late")
+	server.waitSubscriptions(4)
+
+	publisher = dialTestNATS(t, server, NATSOptions{})
+	publisher.Publish("late", []byte("late message"))
+	expectMessage(t, late, "late message")
+}
+
+func TestNATSClose(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+	broker := dialTestNATS(t, server, NATSOptions{})
+
+	err := broker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.Publish("room", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := broker.Subscribe("room", func([]byte) {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestNATSMaxPayload(t *testing.T) {
+	server := newFakeNATSServer(t, 16)
+
+	errs := make(chan error, 16)
+	broker := dialTestNATS(t, server, NATSOptions{
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	if broker.Publish("room", make([]byte, 17)) == nil {
+		t.Fatal("expected publishing past max_payload to fail")
+	}
+
+	_, received := subscribeTestNATS(t, broker, "room")
+	server.waitSubscriptions(1)
+
+	// Refused before anything is allocated, the connection is dropped and restored
+	server.sendRaw("MSG room 1 1073741824\r\n")
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "max_payload") {
+			t.Fatalf("expected a max_payload error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the oversize message to be reported")
+	}
+	server.waitSubscriptions(2)
+
+	err := broker.Publish("room", []byte("fits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, received, "fits")
+}
+
+func TestNATSSlowConsumer(t *testing.T) {
+	server := newFakeNATSServer(t, 0)
+
+	errs := make(chan error, 16)
+	broker := dialTestNATS(t, server, NATSOptions{
+		SubscriptionQueueSize: 1,
+		OnError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	handled := make(chan string, 16)
+	_, err := broker.Subscribe("room", func(data []byte) {
+		started <- struct{}{}
+		<-release
+		handled <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.waitSubscriptions(1)
+
+	// The first one blocks the handler, the second one waits in the queue, the third one is dropped
+	broker.Publish("room", []byte("1"))
+	<-started
+	broker.Publish("room", []byte("2"))
+	broker.Publish("room", []byte("3"))
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrSlowConsumer) {
+			t.Fatalf("expected ErrSlowConsumer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the dropped message to be reported")
+	}
+
+	// Reading went on meanwhile
+	close(release)
+	expectMessage(t, handled, "1")
+	expectMessage(t, handled, "2")
+	expectNoMessage(t, handled)
+}
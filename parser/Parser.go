@@ -1,8 +1,8 @@
 package parser
 
 import (
+	"encoding"
 	"encoding/json"
-	"fmt"
 	"slices"
 	"sync"
 )
@@ -34,11 +34,31 @@ func (h TypedHandler[T]) tryParseAndCallback(data []byte) bool {
 type MessageParsers_Registry struct {
 	mu       sync.RWMutex
 	handlers []messageHandler
+	// Only tried on binary messages, while 'handlers' are only tried on text messages
+	binaryHandlers []messageHandler
 }
 
+// Tries the text message handlers in order of registration, until one of them parses the message
 func (parserRegistry *MessageParsers_Registry) TryDispatch(msg []byte) (callback_called bool) {
-	fmt.Println(len(parserRegistry.handlers), "handlers")
-	for _, handler := range parserRegistry.handlers {
+	parserRegistry.mu.RLock()
+	handlers := parserRegistry.handlers
+	parserRegistry.mu.RUnlock()
+
+	return tryDispatch(handlers, msg)
+}
+
+// Same as TryDispatch() for binary messages
+func (parserRegistry *MessageParsers_Registry) TryDispatchBinary(msg []byte) (callback_called bool) {
+	parserRegistry.mu.RLock()
+	handlers := parserRegistry.binaryHandlers
+	parserRegistry.mu.RUnlock()
+
+	return tryDispatch(handlers, msg)
+}
+
+// The lock isn't held while the callbacks run, so they can (de)register handlers themselves
+func tryDispatch(handlers []messageHandler, msg []byte) bool {
+	for _, handler := range handlers {
 		if handler.tryParseAndCallback(msg) {
 			return true
 		}
@@ -66,29 +86,60 @@ func RegisterMessageParserCallback[T any](r *MessageParsers_Registry, parser Par
 		}
 	}
 
-	messageHandler := TypedHandler[*T]{parser, callback}
+	messageHandler := &TypedHandler[*T]{parser, callback}
 
-	r.handlers = append(r.handlers, messageHandler)
+	// Never appended in place, so that dispatches in progress keep iterating over their own copy
+	r.handlers = append(slices.Clip(r.handlers), messageHandler)
 
-	return &messageHandler
+	return messageHandler
 }
 
-// Generic function to register parser and callback for type T
+// Same as RegisterMessageParserCallback() for binary messages, text messages are never passed to binary parsers
 //
-// if `parser` is nil, the callback will be called upon any non-error unmarshall of messages (not recommended unless it is the only message structure that is received)
-func DeregisterMessageParserCallback[T any](r *MessageParsers_Registry, handler *TypedHandler[*T]) {
+// if `parser` is nil, *T must implement encoding.BinaryUnmarshaler, the callback will then be called upon any non-error UnmarshalBinary() of messages
+func RegisterBinaryMessageParserCallback[T any](r *MessageParsers_Registry, parser ParserFunc[*T], callback CallbackFunc[*T]) *TypedHandler[*T] {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	for i, h := range r.handlers {
-		if typed, ok := h.(TypedHandler[*T]); ok {
-			if &typed == handler {
-				// Remove element from slice
-				r.handlers = slices.Delete(r.handlers, i, i+1)
-				break
+	if parser == nil {
+		parser = func(b []byte) (bool, *T) {
+			var v T
+			unmarshaler, ok := any(&v).(encoding.BinaryUnmarshaler)
+			if !ok {
+				return false, nil
+			}
+
+			err := unmarshaler.UnmarshalBinary(b)
+			if err != nil {
+				return false, nil
 			}
+
+			return true, &v
 		}
 	}
+
+	messageHandler := &TypedHandler[*T]{parser, callback}
+
+	r.binaryHandlers = append(slices.Clip(r.binaryHandlers), messageHandler)
+
+	return messageHandler
+}
+
+// Removes a handler returned by RegisterMessageParserCallback() or RegisterBinaryMessageParserCallback()
+func DeregisterMessageParserCallback[T any](r *MessageParsers_Registry, handler *TypedHandler[*T]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers = removeHandler(r.handlers, handler)
+	r.binaryHandlers = removeHandler(r.binaryHandlers, handler)
+}
+
+// Returns a new slice, so that dispatches in progress keep iterating over their own copy
+func removeHandler[T any](handlers []messageHandler, handler *TypedHandler[*T]) []messageHandler {
+	return slices.DeleteFunc(slices.Clone(handlers), func(h messageHandler) bool {
+		typed, ok := h.(*TypedHandler[*T])
+		return ok && typed == handler
+	})
 }
 
 // This is how it should be in the struct
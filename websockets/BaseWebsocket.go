@@ -2,21 +2,147 @@ package websockets
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	ws "github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
 )
 
 const (
 	HEARTBEAT_CHECK_INTERVAL_SEC        = 5
 	HEARTBEAT_CLOSE_ON_NO_HEARTBEAT_SEC = 20
+	// How long 'CloseWithCode()' waits for the peer to answer the close frame before dropping the connection
+	CLOSE_HANDSHAKE_TIMEOUT_SEC = 5
+	// Default size in bytes above which inbound messages are streamed through 'OnMessageStream' (when set) instead of being buffered
+	STREAM_THRESHOLD_BYTES = 1 << 20
 )
 
+// Describes how a connection ended, passed to every close callback
+type CloseInfo struct {
+	// Close code sent or received, 1006 (Abnormal Closure) if the connection dropped without a close frame
+	Code   int
+	Reason string
+	// Whether this side initiated the close ('Close()', 'CloseWithCode()', read limit or missing heartbeats), false if the peer did
+	Local bool
+	// Whether both close frames were exchanged, false if the connection dropped or the peer didn't answer in time
+	Clean bool
+}
+
+// Returned (through OnError) when the peer sends a message bigger than the configured read limit
+//
+// The connection is then closed with 1009 (Message Too Big)
+var ErrReadLimitExceeded = errors.New("inbound message exceeds the read limit")
+
+// Returned when closing a writer from 'NewWriter()' more than once
+var ErrWriterClosed = errors.New("writer has already been closed")
+
+// permessage-deflate (RFC 7692) settings
+type CompressionOptions struct {
+	// Negotiates per-message compression with the peer, messages are only compressed if the peer agrees
+	Enabled bool
+	// flate compression level, from -2 (Huffman only) to 9 (best compression)
+	//
+	// 0 uses the default level (1)
+	Level int
+	// Messages smaller than this amount of bytes are sent uncompressed
+	//
+	// Prepared messages are only compressed once for all connections, so they are not subject to the threshold
+	Threshold int
+	// Binary messages are sent uncompressed, useful when they are already compressed (images, archives...)
+	SkipBinary bool
+}
+
+func (options CompressionOptions) shouldCompress(messageType int, size int) bool {
+	if !options.Enabled {
+		return false
+	}
+	if options.SkipBinary && messageType == ws.BinaryMessage {
+		return false
+	}
+
+	return size >= options.Threshold
+}
+
+// Options applying to a single underlying connection, whether it was dialed or assigned
+type SocketOptions struct {
+	Compression CompressionOptions
+	// Inbound messages bigger than this amount of bytes are handed to 'OnMessageStream' as they arrive, 0 uses STREAM_THRESHOLD_BYTES
+	//
+	// Ignored while no 'OnMessageStream' is set, messages are then buffered whole as usual
+	StreamThreshold int
+
+	// Called for every inbound data message in the order they arrive, before buffered messages reach 'OnMessage' and after streamed ones have been consumed by 'OnMessageStream' ('msg' is then nil)
+	//
+	// Set before the socket starts reading, so unlike the other callbacks it never misses the first messages
+	OnReceive func(messageType int, msg []byte)
+	// Binary messages starting with one of these prefixes skip the parsers and go straight to 'OnMessage', so that a parser accepting any binary payload can't swallow them
+	ReservedPrefixes [][]byte
+
+	// Called when a callback panics (OnMessage, OnMessageStream, OnError, OnClose and everything they call, like the parsers), the panic is recovered so that it doesn't crash the process
+	//
+	// The socket then keeps reading. While unset, recovered panics are logged
+	OnPanic func(recovered interface{}, stack []byte)
+
+	// The socket doesn't read from the connection, nor check its heartbeats, until 'Start()' is called, so that the owner can finish setting it up before the first message arrives
+	//
+	// Reconnecting sockets only wait for 'Start()' on their first connection, they start the next ones themselves once their callbacks are set
+	ManualStart bool
+}
+
+func (options SocketOptions) streamThreshold() int {
+	if options.StreamThreshold <= 0 {
+		return STREAM_THRESHOLD_BYTES
+	}
+
+	return options.StreamThreshold
+}
+
+// Options used when dialing a new connection
+type DialOptions struct {
+	// Defaults to ws.DefaultDialer
+	Dialer *ws.Dialer
+	// Query parameters set on the URL before dialing
+	Query url.Values
+	// Maximum size in bytes of an inbound message, 0 means unlimited
+	ReadLimit int64
+
+	// Equivalent endpoints used by reconnecting sockets instead of the static URL, the first one being the primary
+	Endpoints        []string
+	EndpointStrategy EndpointStrategy
+	// Interval at which 'EndpointStrategy_Priority' re-checks the primary endpoint while connected to a fallback
+	//
+	// Default is PRIMARY_RECHECK_INTERVAL_SEC, negative disables the re-check
+	PrimaryRecheckInterval time.Duration
+
+	// Called by reconnecting sockets before every dial attempt, the returned URL replaces the static one and the endpoints
+	//
+	// 'Query' is still applied on top of the returned URL
+	URLProvider func(ctx context.Context) (string, error)
+	// Called by reconnecting sockets before every dial attempt, the returned headers are added to (and override) the static ones
+	HeaderProvider func(ctx context.Context) (http.Header, error)
+
+	SocketOptions
+}
+
+func (options DialOptions) getDialer() *ws.Dialer {
+	if options.Dialer == nil {
+		return ws.DefaultDialer
+	}
+
+	return options.Dialer
+}
+
 // type websocket_CombinedStream_Message struct {
 // 	Stream string              `json:"stream"`
 // 	Data   jsoniter.RawMessage `json:"data"`
@@ -28,21 +154,50 @@ const (
 type baseWebsocket struct {
 	// Host server's URL
 	url                     string
-	lastHeartbeat_Timestamp time.Time
+	connectedAt             time.Time
+	lastHeartbeat_Timestamp atomic.Int64 // Unix milliseconds
+	latency                 atomic.Int64 // Nanoseconds, measured from the last ping/pong round-trip
 	closed                  atomic.Bool
+	// Set once this side has sent its close frame
+	closing atomic.Bool
+	// Closed once the peer's close frame arrives after ours
+	closeReceived     chan struct{}
+	closeReceivedOnce sync.Once
+	startOnce         sync.Once
+
+	messagesReceived atomic.Uint64
+	messagesSent     atomic.Uint64
+	bytesReceived    atomic.Uint64
+	bytesSent        atomic.Uint64
 
 	conn    *ws.Conn
 	writeMu sync.Mutex
+	options SocketOptions
 
 	OnMessage func(messageType int, msg []byte)
-	OnError   func(err error)
-	OnClose   func(code int, reason string)
+	// Called instead of OnMessage for messages bigger than the stream threshold, returns false if the message wasn't consumed, in which case it is buffered and passed to OnMessage
+	//
+	// The reader is only valid until the callback returns
+	OnMessageStream func(messageType int, reader io.Reader) (handled bool)
+	OnError         func(err error)
+	OnClose         func(info CloseInfo)
 }
 
-func (socket *baseWebsocket) init(conn *ws.Conn, URL string) {
+func (socket *baseWebsocket) init(conn *ws.Conn, URL string, options SocketOptions) {
 	socket.url = URL
-	socket.lastHeartbeat_Timestamp = time.Now()
+	socket.connectedAt = time.Now()
+	socket.recordLastHeartbeat()
 	socket.conn = conn
+	socket.options = options
+	socket.closeReceived = make(chan struct{})
+
+	if options.Compression.Enabled && options.Compression.Level != 0 {
+		// No-op if compression wasn't negotiated
+		err := socket.conn.SetCompressionLevel(options.Compression.Level)
+		if err != nil {
+			Logger.WARN(fmt.Sprintf("[%s] Invalid compression level %d, using the default", socket.url, options.Compression.Level), err)
+		}
+	}
 
 	////
 
@@ -52,11 +207,20 @@ func (socket *baseWebsocket) init(conn *ws.Conn, URL string) {
 
 	////
 
-	go socket.listen()
-	go socket.checkHeartbeats()
+	if !options.ManualStart {
+		socket.start()
+	}
+}
+
+// Starts reading from the connection and checking its heartbeats, only once
+func (socket *baseWebsocket) start() {
+	socket.startOnce.Do(func() {
+		go socket.listen()
+		go socket.checkHeartbeats()
+	})
 }
 
-func (socket *baseWebsocket) markAsClosed(code int, reason string) {
+func (socket *baseWebsocket) markAsClosed(info CloseInfo) {
 	// CompareAndSwap returns "true" if the swap was successful
 	// Meaning that socket.closed was false, which means that if it were true, we'd want to emit the OnClose()
 	wasFalseAndHasBeenSwappedToTrue := socket.closed.CompareAndSwap(false, true)
@@ -67,8 +231,34 @@ func (socket *baseWebsocket) markAsClosed(code int, reason string) {
 	}
 
 	if socket.OnClose != nil {
-		socket.OnClose(code, reason)
+		socket.guard(func() { socket.OnClose(info) })
+	}
+}
+
+// Runs a callback, recovering from a panic so that it can't crash the process
+func (socket *baseWebsocket) guard(callback func()) {
+	defer socket.recoverPanic()
+
+	callback()
+}
+
+func (socket *baseWebsocket) recoverPanic() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	if socket.options.OnPanic == nil {
+		Logger.ERROR(fmt.Sprintf("[%s] Recovered from a panic in a callback: %v\n%s", socket.url, recovered, stack))
+		return
 	}
+
+	// OnPanic itself mustn't crash the process either
+	defer func() {
+		recover()
+	}()
+	socket.options.OnPanic(recovered, stack)
 }
 
 func (socket *baseWebsocket) onPing(pingData string) error {
@@ -89,12 +279,29 @@ func (socket *baseWebsocket) onPing(pingData string) error {
 func (socket *baseWebsocket) onPong(appData string) error {
 	socket.recordLastHeartbeat()
 
+	// Our pings carry the UNIX timestamp (ms) they were sent at, see sendPing()
+	if len(appData) == 8 {
+		sentAt := int64(binary.BigEndian.Uint64([]byte(appData)))
+		socket.latency.Store(int64(time.Since(time.UnixMilli(sentAt))))
+	}
+
 	return nil
 }
 
 func (socket *baseWebsocket) closeHandler(code int, text string) error {
 	Logger.DEBUG(fmt.Sprintf("[*Websocket.CloseHandler()] code: %d, text: %s, isClosed: %v", code, text, socket.closed.Load()))
-	socket.markAsClosed(code, text)
+
+	// We initiated the close, this is the peer's answer, 'CloseWithCode()' takes it from here
+	if socket.closing.Load() {
+		socket.closeReceivedOnce.Do(func() { close(socket.closeReceived) })
+		return nil
+	}
+
+	// The peer initiated the close, echo its code back to complete the handshake
+	socket.conn.WriteControl(ws.CloseMessage, ws.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+
+	socket.conn.Close()
+	socket.markAsClosed(CloseInfo{Code: code, Reason: text, Local: false, Clean: true})
 
 	return nil
 }
@@ -104,21 +311,28 @@ func (socket *baseWebsocket) onMessage(messageType int, msg []byte) {
 		return
 	}
 
+	socket.messagesReceived.Add(1)
+	socket.bytesReceived.Add(uint64(len(msg)))
+
+	if socket.options.OnReceive != nil {
+		socket.options.OnReceive(messageType, msg)
+	}
+
 	if socket.OnMessage != nil {
-		socket.OnMessage(messageType, msg)
+		socket.guard(func() { socket.OnMessage(messageType, msg) })
 	}
 }
 
 func (socket *baseWebsocket) onError(err error) {
 	if socket.OnError != nil {
-		socket.OnError(err)
+		socket.guard(func() { socket.OnError(err) })
 	}
 
-	socket.markAsClosed(ws.CloseInternalServerErr, err.Error())
+	socket.markAsClosed(CloseInfo{Code: ws.CloseAbnormalClosure, Reason: err.Error(), Local: false, Clean: false})
 }
 
 func (socket *baseWebsocket) recordLastHeartbeat() {
-	socket.lastHeartbeat_Timestamp = time.Now()
+	socket.lastHeartbeat_Timestamp.Store(time.Now().UnixMilli())
 }
 
 func (socket *baseWebsocket) listen() {
@@ -127,18 +341,78 @@ func (socket *baseWebsocket) listen() {
 		if socket.closed.Load() {
 			return
 		}
-		msgType, msg, err := socket.conn.ReadMessage()
+		msgType, reader, err := socket.conn.NextReader()
+		if err == nil {
+			socket.recordLastHeartbeat()
+			err = socket.readMessage(msgType, reader)
+		}
+		if errors.Is(err, ws.ErrReadLimit) {
+			// gorilla has already sent the 1009 close frame to the peer
+			Logger.ERROR(fmt.Sprintf("[%s] Inbound message exceeds the read limit", socket.url), err)
+			if socket.OnError != nil {
+				socket.guard(func() { socket.OnError(ErrReadLimitExceeded) })
+			}
+
+			socket.conn.Close()
+			socket.markAsClosed(CloseInfo{Code: ws.CloseMessageTooBig, Reason: ErrReadLimitExceeded.Error(), Local: true, Clean: false})
+			return
+		}
+		var closeErr *ws.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code != ws.CloseAbnormalClosure {
+			// Close frames are handled by closeHandler(), 1006 is never sent and stands for a connection dropped without one
+			return
+		}
+		if err != nil && socket.closing.Load() {
+			// The connection was dropped by 'CloseWithCode()' while waiting on the peer
+			return
+		}
 		if err != nil {
 			Logger.ERROR(fmt.Sprintf("[%s] Error reading message", socket.url), err)
 			socket.onError(err)
 			return
 		}
+	}
+}
+
+// Buffers messages up to the stream threshold, bigger ones are handed to OnMessageStream as they arrive
+func (socket *baseWebsocket) readMessage(messageType int, reader io.Reader) error {
+	var buffer bytes.Buffer
+	_, err := io.CopyN(&buffer, reader, int64(socket.options.streamThreshold())+1)
+	if err == io.EOF {
+		Logger.DEBUG(fmt.Sprintf("Type: %d, message: %s\n", messageType, buffer.String()))
+
+		socket.onMessage(messageType, buffer.Bytes())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		Logger.DEBUG(fmt.Sprintf("Type: %d, message: %s\n", msgType, string(msg)))
-		socket.recordLastHeartbeat()
+	// Bigger than the threshold, the already buffered part is replayed in front of the rest of the message
+	stream := io.MultiReader(&buffer, reader)
+
+	if socket.OnMessageStream != nil && !socket.closed.Load() {
+		// A stream whose callback panicked has been partially read, it can't be buffered anymore
+		handled := true
+		socket.guard(func() {
+			handled = socket.OnMessageStream(messageType, &countingReader{reader: stream, count: &socket.bytesReceived})
+		})
+		if handled {
+			socket.messagesReceived.Add(1)
+			if socket.options.OnReceive != nil {
+				socket.options.OnReceive(messageType, nil)
+			}
+			return nil
+		}
+	}
 
-		socket.onMessage(msgType, msg)
+	msg, err := io.ReadAll(stream)
+	if err != nil {
+		return err
 	}
+	socket.onMessage(messageType, msg)
+
+	return nil
 }
 
 func (socket *baseWebsocket) checkHeartbeats() {
@@ -156,11 +430,14 @@ func (socket *baseWebsocket) checkHeartbeats() {
 
 		currentTime := time.Now()
 
-		elapsed := currentTime.Unix() - socket.lastHeartbeat_Timestamp.Unix()
+		elapsed := (currentTime.UnixMilli() - socket.lastHeartbeat_Timestamp.Load()) / 1000
 
 		// Check if the last heartbeat is older than the close interval
 		if elapsed >= HEARTBEAT_CLOSE_ON_NO_HEARTBEAT_SEC {
 			Logger.DEBUG("[HEARTBEAT] No heartbeat detected, socket will terminate.")
+			socket.closing.Store(true)
+			socket.conn.Close()
+			socket.markAsClosed(CloseInfo{Code: ws.CloseAbnormalClosure, Reason: "no heartbeat received", Local: true, Clean: false})
 			return
 		}
 
@@ -177,73 +454,239 @@ func (socket *baseWebsocket) checkHeartbeats() {
 	}
 }
 
+// Control frames don't take the write lock, so heartbeats keep flowing while a writer from NewWriter() is open
 func (socket *baseWebsocket) sendPing() error {
-	socket.writeMu.Lock()
-	defer socket.writeMu.Unlock()
-
 	// Get current UNIX timestamp in int64 and encode it
 	timestamp := time.Now().UnixMilli()
 	buf := new(bytes.Buffer)
 	_ = binary.Write(buf, binary.BigEndian, timestamp)
 
-	return socket.conn.WriteMessage(ws.PingMessage, buf.Bytes())
+	return socket.conn.WriteControl(ws.PingMessage, buf.Bytes(), time.Now().Add(time.Second))
 }
 
 func (socket *baseWebsocket) sendPong(data []byte) error {
+	return socket.conn.WriteControl(ws.PongMessage, data, time.Now().Add(time.Second))
+}
+
+// All data messages go through here, so that the sent counters stay accurate
+func (socket *baseWebsocket) writeMessage(messageType int, data []byte) error {
 	socket.writeMu.Lock()
 	defer socket.writeMu.Unlock()
 
-	return socket.conn.WriteMessage(ws.PongMessage, data)
+	// No-op if compression wasn't negotiated
+	socket.conn.EnableWriteCompression(socket.options.Compression.shouldCompress(messageType, len(data)))
+
+	err := socket.conn.WriteMessage(messageType, data)
+	if err != nil {
+		return err
+	}
+
+	socket.messagesSent.Add(1)
+	socket.bytesSent.Add(uint64(len(data)))
+
+	return nil
 }
 
 //// Public methods
 
-func (socket *baseWebsocket) SendText(text string) error {
-	socket.writeMu.Lock()
-	defer socket.writeMu.Unlock()
+// Statistics of a single underlying connection
+type Stats struct {
+	ConnectedAt   time.Time
+	LastHeartbeat time.Time
+	// Round-trip time of our last ping/pong exchange, 0 if none has completed yet
+	//
+	// Pings are only sent once no heartbeat was received for the heartbeat interval, so a busy connection, or one whose peer keeps pinging us, may never measure it
+	Latency time.Duration
+
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	// Prepared messages are not included since their size is unknown
+	BytesSent uint64
+}
+
+func (socket *baseWebsocket) GetStats() Stats {
+	return Stats{
+		ConnectedAt:   socket.connectedAt,
+		LastHeartbeat: time.UnixMilli(socket.lastHeartbeat_Timestamp.Load()),
+		Latency:       time.Duration(socket.latency.Load()),
+
+		MessagesReceived: socket.messagesReceived.Load(),
+		MessagesSent:     socket.messagesSent.Load(),
+		BytesReceived:    socket.bytesReceived.Load(),
+		BytesSent:        socket.bytesSent.Load(),
+	}
+}
 
-	return socket.conn.WriteMessage(ws.TextMessage, []byte(text))
+// Returns the subprotocol negotiated during the handshake, empty if none
+func (socket *baseWebsocket) GetSubprotocol() string {
+	return socket.conn.Subprotocol()
+}
+
+func (socket *baseWebsocket) SendText(text string) error {
+	return socket.writeMessage(ws.TextMessage, []byte(text))
 }
 
 func (socket *baseWebsocket) SendJSON(v interface{}) error {
-	socket.writeMu.Lock()
-	defer socket.writeMu.Unlock()
+	data, err := jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return socket.writeMessage(ws.TextMessage, data)
+}
 
-	return socket.conn.WriteJSON(v)
+func (socket *baseWebsocket) SendBinary(data []byte) error {
+	return socket.writeMessage(ws.BinaryMessage, data)
 }
 
 func (socket *baseWebsocket) SendPreparedMessage(preparedMessage *ws.PreparedMessage) error {
 	socket.writeMu.Lock()
 	defer socket.writeMu.Unlock()
 
-	return socket.conn.WritePreparedMessage(preparedMessage)
+	// The prepared message caches one frame per compression setting, so every connection is sent the variant it negotiated
+	socket.conn.EnableWriteCompression(socket.options.Compression.Enabled)
+
+	err := socket.conn.WritePreparedMessage(preparedMessage)
+	if err != nil {
+		return err
+	}
+
+	socket.messagesSent.Add(1)
+
+	return nil
+}
+
+// Returns a writer streaming a single message of 'messageType', the message is complete once the writer is closed
+//
+// The write lock is held until then, so every other send blocks meanwhile (pings and close frames still go through)
+//
+// NOTE: The message size is unknown up front, so compression ignores 'CompressionOptions.Threshold'
+func (socket *baseWebsocket) NewWriter(messageType int) (io.WriteCloser, error) {
+	socket.writeMu.Lock()
+
+	socket.conn.EnableWriteCompression(socket.options.Compression.shouldCompress(messageType, math.MaxInt))
+
+	writer, err := socket.conn.NextWriter(messageType)
+	if err != nil {
+		socket.writeMu.Unlock()
+		return nil, err
+	}
+
+	return &messageWriter{socket: socket, writer: writer}, nil
 }
 
+// Same as 'CloseWithCode()' with 1000 (Normal Closure)
 func (socket *baseWebsocket) Close() {
-	socket.conn.Close()
+	socket.CloseWithCode(ws.CloseNormalClosure, "Normal Closure")
+}
+
+// Starts the close handshake, sending a close frame with the given code and reason
+//
+// The underlying connection is closed once the peer answers, or after CLOSE_HANDSHAKE_TIMEOUT_SEC, and only then is OnClose called
+//
+// Returns ErrSocketClosed if the socket is already closed or closing, or the error encountered while sending the close frame (in which case the connection is dropped right away)
+func (socket *baseWebsocket) CloseWithCode(code int, reason string) error {
+	if socket.closed.Load() || !socket.closing.CompareAndSwap(false, true) {
+		return ErrSocketClosed
+	}
+
+	err := socket.conn.WriteControl(ws.CloseMessage, ws.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	if err != nil {
+		socket.conn.Close()
+		socket.markAsClosed(CloseInfo{Code: code, Reason: reason, Local: true, Clean: false})
+		return err
+	}
+
+	// Waits in the background, as this may be called from within the read loop which has to keep reading for the answer
+	go func() {
+		clean := false
+		select {
+		case <-socket.closeReceived:
+			clean = true
+		case <-time.After(CLOSE_HANDSHAKE_TIMEOUT_SEC * time.Second):
+			Logger.DEBUG(fmt.Sprintf("[%s] The peer didn't answer the close frame in time", socket.url))
+		}
 
-	socket.markAsClosed(ws.CloseNormalClosure, "Normal Closure")
+		socket.conn.Close()
+		socket.markAsClosed(CloseInfo{Code: code, Reason: reason, Local: true, Clean: clean})
+	}()
+
+	return nil
 }
 
 ////
 
-func createBaseSocket(URL string, httpHeader http.Header) (*baseWebsocket, error) {
-	conn, _, err := ws.DefaultDialer.Dial(URL, httpHeader)
+func createBaseSocket(URL string, httpHeader http.Header, options DialOptions) (*baseWebsocket, error) {
+	URL, err := applyQuery(URL, options.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := options.getDialer().Dial(URL, httpHeader)
 	if err != nil {
 		Logger.ERROR("There was an error creating websocket", err)
 		return nil, err
 	}
 	Logger.DEBUG(fmt.Sprintf("Socket connected: %v", URL))
 
+	if options.ReadLimit > 0 {
+		conn.SetReadLimit(options.ReadLimit)
+	}
+
 	var socket baseWebsocket
-	socket.init(conn, URL)
+	socket.init(conn, URL, options.SocketOptions)
 
 	return &socket, nil
 }
 
-func assignBaseSocket(conn *ws.Conn, URL string) *baseWebsocket {
+func assignBaseSocket(conn *ws.Conn, URL string, options SocketOptions) *baseWebsocket {
 	var socket baseWebsocket
-	socket.init(conn, URL)
+	socket.init(conn, URL, options)
 
 	return &socket
 }
+
+//// Streaming
+
+// Releases the socket's write lock once closed, see 'NewWriter()'
+type messageWriter struct {
+	socket *baseWebsocket
+	writer io.WriteCloser
+
+	closeOnce sync.Once
+}
+
+func (writer *messageWriter) Write(p []byte) (int, error) {
+	n, err := writer.writer.Write(p)
+	writer.socket.bytesSent.Add(uint64(n))
+
+	return n, err
+}
+
+func (writer *messageWriter) Close() error {
+	err := ErrWriterClosed
+	writer.closeOnce.Do(func() {
+		defer writer.socket.writeMu.Unlock()
+
+		err = writer.writer.Close()
+		if err == nil {
+			writer.socket.messagesSent.Add(1)
+		}
+	})
+
+	return err
+}
+
+// Counts the bytes read from a streamed message into the socket's stats
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Uint64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.count.Add(uint64(n))
+
+	return n, err
+}
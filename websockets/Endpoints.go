@@ -0,0 +1,155 @@
+package websockets
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type EndpointStrategy int
+
+const (
+	// Every connection attempt moves on to the next endpoint
+	EndpointStrategy_RoundRobin EndpointStrategy = iota
+	// Every reconnection starts from the first (primary) endpoint and falls back down the list on failure
+	//
+	// While connected to a fallback, the primary is periodically re-checked and switched back to once it is reachable
+	EndpointStrategy_Priority
+	// Endpoints are tried from the lowest to the highest measured latency, unmeasured endpoints first
+	EndpointStrategy_LowestLatency
+)
+
+// Default interval at which the primary endpoint is re-checked by 'EndpointStrategy_Priority'
+const PRIMARY_RECHECK_INTERVAL_SEC = 30
+
+type endpointState struct {
+	url string
+	// Latest handshake or ping round-trip, 0 if never measured
+	latency time.Duration
+	// Consecutive failed connection attempts
+	failures int
+}
+
+// Picks the endpoint of each connection attempt according to the strategy
+type endpointSelector struct {
+	mu sync.Mutex
+
+	strategy  EndpointStrategy
+	endpoints []*endpointState
+
+	// Round-robin cursor
+	next int
+	// Endpoints already picked by 'EndpointStrategy_LowestLatency' during the current cycle of attempts
+	tried map[string]struct{}
+}
+
+func newEndpointSelector(endpoints []string, strategy EndpointStrategy) *endpointSelector {
+	var selector endpointSelector
+	selector.strategy = strategy
+
+	for _, endpoint := range endpoints {
+		selector.endpoints = append(selector.endpoints, &endpointState{url: endpoint})
+	}
+	selector.tried = make(map[string]struct{})
+
+	return &selector
+}
+
+// Returns the endpoint to use for the given attempt of a (re)connection, 'attempt' starting at 0
+func (selector *endpointSelector) pick(attempt int) string {
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+
+	switch selector.strategy {
+	case EndpointStrategy_Priority:
+		return selector.endpoints[attempt%len(selector.endpoints)].url
+
+	case EndpointStrategy_LowestLatency:
+		// Every endpoint is tried once per cycle, whatever the failures reported meanwhile reorder
+		if attempt%len(selector.endpoints) == 0 || len(selector.tried) >= len(selector.endpoints) {
+			clear(selector.tried)
+		}
+
+		ordered := make([]*endpointState, len(selector.endpoints))
+		copy(ordered, selector.endpoints)
+
+		// Failing endpoints are pushed back, then the fastest ones are preferred
+		sort.SliceStable(ordered, func(i, j int) bool {
+			if ordered[i].failures != ordered[j].failures {
+				return ordered[i].failures < ordered[j].failures
+			}
+			return ordered[i].latency < ordered[j].latency
+		})
+
+		for _, endpoint := range ordered {
+			if _, tried := selector.tried[endpoint.url]; !tried {
+				selector.tried[endpoint.url] = struct{}{}
+				return endpoint.url
+			}
+		}
+
+		return ordered[0].url
+
+	default:
+		endpoint := selector.endpoints[selector.next%len(selector.endpoints)]
+		selector.next++
+
+		return endpoint.url
+	}
+}
+
+func (selector *endpointSelector) get(endpoint string) *endpointState {
+	for _, state := range selector.endpoints {
+		if state.url == endpoint {
+			return state
+		}
+	}
+
+	return nil
+}
+
+func (selector *endpointSelector) reportSuccess(endpoint string, latency time.Duration) {
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+
+	state := selector.get(endpoint)
+	if state == nil {
+		return
+	}
+
+	state.failures = 0
+	state.latency = latency
+}
+
+func (selector *endpointSelector) reportFailure(endpoint string) {
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+
+	state := selector.get(endpoint)
+	if state == nil {
+		return
+	}
+
+	state.failures++
+}
+
+// Records a ping round-trip measured while connected, ignored if 0
+func (selector *endpointSelector) reportLatency(endpoint string, latency time.Duration) {
+	if latency <= 0 {
+		return
+	}
+
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+
+	state := selector.get(endpoint)
+	if state == nil {
+		return
+	}
+
+	state.latency = latency
+}
+
+func (selector *endpointSelector) primary() string {
+	return selector.endpoints[0].url
+}
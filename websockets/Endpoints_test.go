@@ -0,0 +1,95 @@
+package websockets
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEndpointSelectorPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy EndpointStrategy
+		// Called before picking, to report the measured latencies
+		setup func(selector *endpointSelector)
+		// Whether every pick is reported as failed
+		failing  bool
+		attempts []int
+		expected []string
+	}{
+		{
+			name:     "round robin moves on every attempt",
+			strategy: EndpointStrategy_RoundRobin,
+			attempts: []int{0, 1, 0, 0},
+			expected: []string{"A", "B", "C", "A"},
+		},
+		{
+			name:     "priority restarts from the primary",
+			strategy: EndpointStrategy_Priority,
+			attempts: []int{0, 1, 2, 3, 0},
+			expected: []string{"A", "B", "C", "A", "A"},
+		},
+		{
+			name:     "lowest latency prefers the fastest",
+			strategy: EndpointStrategy_LowestLatency,
+			setup: func(selector *endpointSelector) {
+				selector.reportSuccess("A", 30*time.Millisecond)
+				selector.reportSuccess("B", 10*time.Millisecond)
+				selector.reportSuccess("C", 20*time.Millisecond)
+			},
+			attempts: []int{0, 0},
+			expected: []string{"B", "B"},
+		},
+		{
+			name:     "lowest latency tries unmeasured endpoints first",
+			strategy: EndpointStrategy_LowestLatency,
+			setup: func(selector *endpointSelector) {
+				selector.reportSuccess("A", 30*time.Millisecond)
+			},
+			attempts: []int{0},
+			expected: []string{"B"},
+		},
+		{
+			name:     "lowest latency tries every failing endpoint once per cycle",
+			strategy: EndpointStrategy_LowestLatency,
+			failing:  true,
+			attempts: []int{0, 1, 2, 3, 4, 5},
+			expected: []string{"A", "B", "C", "A", "B", "C"},
+		},
+		{
+			name:     "lowest latency moves past the failing fastest endpoint",
+			strategy: EndpointStrategy_LowestLatency,
+			setup: func(selector *endpointSelector) {
+				selector.reportSuccess("A", 10*time.Millisecond)
+				selector.reportSuccess("B", 20*time.Millisecond)
+				selector.reportSuccess("C", 30*time.Millisecond)
+			},
+			failing:  true,
+			attempts: []int{0, 1, 2, 0},
+			expected: []string{"A", "B", "C", "A"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector := newEndpointSelector([]string{"A", "B", "C"}, test.strategy)
+			if test.setup != nil {
+				test.setup(selector)
+			}
+
+			var picked []string
+			for _, attempt := range test.attempts {
+				endpoint := selector.pick(attempt)
+				picked = append(picked, endpoint)
+
+				if test.failing {
+					selector.reportFailure(endpoint)
+				}
+			}
+
+			if !slices.Equal(picked, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, picked)
+			}
+		})
+	}
+}
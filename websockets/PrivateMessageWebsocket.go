@@ -1,18 +1,29 @@
 package websockets
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	ws "github.com/gorilla/websocket"
 )
 
+// Returned by 'SendPrivateMessage()' when the connection drops before the response is received, the response can never arrive
+//
+// The returned error wraps ErrDisconnected along with the close code and reason, use errors.Is() to check for it
+var ErrDisconnected = errors.New("disconnected before the response was received")
+
 type pendingRequest struct {
 	id   string
 	once sync.Once
 	ch   chan []byte
+	// Set before 'ch' is closed when the request failed
+	err error
 }
 
 type privateMessageWebsocket struct {
@@ -27,8 +38,10 @@ type privateMessageWebsocket struct {
 	}
 
 	OnMessage func(messageType int, msg []byte)
-	OnError   func(err error)
-	OnClose   func(code int, reason string)
+	// Called instead of OnMessage for messages bigger than the stream threshold, returns false if the message wasn't consumed
+	OnMessageStream func(messageType int, reader io.Reader) (handled bool)
+	OnError         func(err error)
+	OnClose         func(info CloseInfo)
 }
 
 func (socket *privateMessageWebsocket) init(baseSocket *baseWebsocket, privateMessagePropertyName string, isServer bool) {
@@ -42,6 +55,7 @@ func (socket *privateMessageWebsocket) init(baseSocket *baseWebsocket, privateMe
 	//
 
 	socket.base.OnMessage = socket.onMessage
+	socket.base.OnMessageStream = socket.onMessageStream
 	socket.base.OnError = socket.onError
 	socket.base.OnClose = socket.onClose
 }
@@ -75,17 +89,32 @@ func (socket *privateMessageWebsocket) getPendingRequest(id string) (request *pe
 }
 
 func (socket *privateMessageWebsocket) removePendingRequest(id string) {
-	pendingRequest, exists := socket.getPendingRequest(id)
-
 	socket.pendingRequests.Mu.Lock()
 	defer socket.pendingRequests.Mu.Unlock()
 
+	pendingRequest, exists := socket.pendingRequests.Map[id]
 	if exists {
 		delete(socket.pendingRequests.Map, id)
 		close(pendingRequest.ch)
 	}
 }
 
+// Fails every pending request with 'err', except those whose response is already being delivered
+func (socket *privateMessageWebsocket) failPendingRequests(err error) {
+	socket.pendingRequests.Mu.Lock()
+	requests := slices.Collect(maps.Values(socket.pendingRequests.Map))
+	socket.pendingRequests.Mu.Unlock()
+
+	for _, request := range requests {
+		request.once.Do(
+			func() {
+				request.err = err
+				socket.removePendingRequest(request.id)
+			},
+		)
+	}
+}
+
 func (socket *privateMessageWebsocket) sendChanThenDeleteWithTimeout(pendingRequest *pendingRequest, data []byte, timeout_sec int) {
 	timeout_duration := time.Duration(timeout_sec) * time.Second
 
@@ -110,14 +139,25 @@ func (socket *privateMessageWebsocket) onError(err error) {
 	}
 }
 
-func (socket *privateMessageWebsocket) onClose(code int, reason string) {
+func (socket *privateMessageWebsocket) onClose(info CloseInfo) {
+	socket.failPendingRequests(fmt.Errorf("%w (code %d: %s)", ErrDisconnected, info.Code, info.Reason))
+
 	if socket.OnClose != nil {
-		socket.OnClose(code, reason)
+		socket.OnClose(info)
+	}
+}
+
+// Streamed messages are never private responses, they go straight up
+func (socket *privateMessageWebsocket) onMessageStream(messageType int, reader io.Reader) bool {
+	if socket.OnMessageStream == nil {
+		return false
 	}
+
+	return socket.OnMessageStream(messageType, reader)
 }
 
 func (socket *privateMessageWebsocket) onMessage(msgType int, msg []byte) {
-	requestId, isPrivate := CheckMessageIsPrivate(msg, socket.privateMessagePropertyName)
+	requestId, isPrivate := CheckMessageTypeIsPrivate(msgType, msg, socket.privateMessagePropertyName)
 	if isPrivate {
 		pendingRequest, exists := socket.getPendingRequest(requestId)
 		if exists {
@@ -136,6 +176,18 @@ func (socket *privateMessageWebsocket) onMessage(msgType int, msg []byte) {
 
 // Public Methods
 
+func (socket *privateMessageWebsocket) GetStats() Stats {
+	return socket.base.GetStats()
+}
+
+func (socket *privateMessageWebsocket) start() {
+	socket.base.start()
+}
+
+func (socket *privateMessageWebsocket) GetSubprotocol() string {
+	return socket.base.GetSubprotocol()
+}
+
 func (socket *privateMessageWebsocket) SendText(text string) error {
 	return socket.base.SendText(text)
 }
@@ -145,7 +197,18 @@ func (socket *privateMessageWebsocket) SendJSON(v interface{}) error {
 	return socket.base.SendJSON(v)
 }
 
+// If the connection drops before the response arrives, an error wrapping ErrDisconnected is returned immediately
 func (socket *privateMessageWebsocket) SendPrivateMessage(message map[string]interface{}, timeout_sec ...int) (response []byte, hasTimedOut bool, err error) {
+	timeout := 4
+	if len(timeout_sec) > 0 {
+		timeout = timeout_sec[0]
+	}
+
+	return socket.sendPrivateMessage(message, time.Duration(timeout)*time.Second)
+}
+
+// A timeout <= 0 waits indefinitely
+func (socket *privateMessageWebsocket) sendPrivateMessage(message map[string]interface{}, timeout time.Duration) (response []byte, hasTimedOut bool, err error) {
 	request := socket.addPendingRequest()
 
 	Logger.INFO(fmt.Sprintf("Sending private request of id %s => %v", request.id, message))
@@ -155,22 +218,25 @@ func (socket *privateMessageWebsocket) SendPrivateMessage(message map[string]int
 	err = socket.SendJSON(message)
 	if err != nil {
 		Logger.ERROR(fmt.Sprintf("[%s] There was an error sending JSON for private message", socket.base.url), err)
-		return nil, false, err
-	}
+		socket.removePendingRequest(request.id)
 
-	timeout := 4
-	if len(timeout_sec) > 0 {
-		timeout = timeout_sec[0]
+		if socket.base.closed.Load() {
+			err = fmt.Errorf("%w: %w", ErrDisconnected, err)
+		}
+		return nil, false, err
 	}
 
 	// Wait for response or timeout
 	var timer <-chan time.Time
 	if timeout > 0 {
-		timer = time.After(time.Duration(timeout) * time.Second)
+		timer = time.After(timeout)
 	}
 
 	select {
-	case resp := <-request.ch:
+	case resp, ok := <-request.ch:
+		if !ok {
+			return nil, false, request.err
+		}
 		return resp, false, nil
 	case <-timer:
 		request.once.Do(
@@ -178,22 +244,34 @@ func (socket *privateMessageWebsocket) SendPrivateMessage(message map[string]int
 				socket.removePendingRequest(request.id)
 			},
 		)
-		return nil, true, fmt.Errorf("the request has timed out after %d seconds", timeout)
+		return nil, true, fmt.Errorf("the request has timed out after %s", timeout)
 	}
 }
 
+func (socket *privateMessageWebsocket) SendBinary(data []byte) error {
+	return socket.base.SendBinary(data)
+}
+
 func (socket *privateMessageWebsocket) SendPreparedMessage(preparedMessage *ws.PreparedMessage) error {
 	return socket.base.SendPreparedMessage(preparedMessage)
 }
 
+func (socket *privateMessageWebsocket) NewWriter(messageType int) (io.WriteCloser, error) {
+	return socket.base.NewWriter(messageType)
+}
+
 func (socket *privateMessageWebsocket) Close() {
 	socket.base.Close()
 }
 
+func (socket *privateMessageWebsocket) CloseWithCode(code int, reason string) error {
+	return socket.base.CloseWithCode(code, reason)
+}
+
 //
 
-func createPrivateMessageWebsocket(URL string, privateMessagePropertyName string, httpHeader http.Header, isServer bool) (*privateMessageWebsocket, error) {
-	baseSocket, err := createBaseSocket(URL, httpHeader)
+func createPrivateMessageWebsocket(URL string, privateMessagePropertyName string, httpHeader http.Header, isServer bool, dialOptions DialOptions) (*privateMessageWebsocket, error) {
+	baseSocket, err := createBaseSocket(URL, httpHeader, dialOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -204,10 +282,10 @@ func createPrivateMessageWebsocket(URL string, privateMessagePropertyName string
 	return &socket, nil
 }
 
-func assignPrivateMessageWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool) *privateMessageWebsocket {
+func assignPrivateMessageWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool, options SocketOptions) *privateMessageWebsocket {
 	var socket privateMessageWebsocket
 
-	baseSocket := assignBaseSocket(conn, URL)
+	baseSocket := assignBaseSocket(conn, URL, options)
 	socket.init(baseSocket, privateMessagePropertyName, isServer)
 
 	return &socket
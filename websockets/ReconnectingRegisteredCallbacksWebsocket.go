@@ -1,7 +1,10 @@
 package websockets
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"sync/atomic"
@@ -12,51 +15,166 @@ import (
 )
 
 type ReconnectingRegisteredCallbacksWebsocket struct {
-	base                       *RegisteredCallbacksWebsocket
+	// The current subsocket, swapped on every reconnect and when switching back to the primary endpoint
+	base                       atomic.Pointer[RegisteredCallbacksWebsocket]
 	privateMessagePropertyName string
 
-	url        string
-	isServer   bool
-	httpHeader http.Header
-	ready      atomic.Bool
-	closed     atomic.Bool
-
-	OnMessage        func(messageType int, msg []byte)
-	OnError          func(err error)
-	OnDisconnect     func(code int, reason string)
+	url         string
+	isServer    bool
+	httpHeader  http.Header
+	dialOptions DialOptions
+	state       stateMachine
+
+	// nil unless multiple endpoints were given
+	endpoints *endpointSelector
+	// URL of the current subsocket
+	activeEndpoint atomic.Value
+	// Set by 'Start()' when created with 'ManualStart', the first subsocket doesn't read until then
+	started atomic.Bool
+
+	// Cancelled once the socket is manually closed, passed to the URL/header providers
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	OnMessage func(messageType int, msg []byte)
+	// Called instead of OnMessage for messages bigger than the stream threshold, returns false if the message wasn't consumed
+	OnMessageStream func(messageType int, reader io.Reader) (handled bool)
+	OnError         func(err error)
+	// Called once the connection unexpectedly drops, before reconnecting
+	OnDisconnect     func(info CloseInfo)
 	OnReconnectError func(err error)
-	OnReconnect      func()
+	// 'endpoint' is the URL the socket is now connected to
+	OnReconnect func(endpoint string)
+	// Called on every state transition
+	//
+	// NOTE: The first Connecting -> Open transition happens before the socket is returned, so it is never emitted
+	OnStateChange func(old State, new State)
+	// Called once the socket has been manually closed, after the close handshake completed (or timed out)
+	OnClose func(info CloseInfo)
 }
 
-func (socket *ReconnectingRegisteredCallbacksWebsocket) init(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header) {
+func (socket *ReconnectingRegisteredCallbacksWebsocket) init(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header, dialOptions DialOptions) {
 	socket.url = URL
 	socket.privateMessagePropertyName = privateMessagePropertyName
 	socket.isServer = isServer
 	socket.httpHeader = httpHeader
+	socket.dialOptions = dialOptions
+
+	socket.ctx, socket.cancel = context.WithCancel(context.Background())
+
+	socket.state.init(State_Connecting)
+	socket.state.OnStateChange = socket.onStateChange
+
+	if len(dialOptions.Endpoints) != 0 {
+		socket.endpoints = newEndpointSelector(dialOptions.Endpoints, dialOptions.EndpointStrategy)
+	}
+	socket.activeEndpoint.Store(URL)
 }
 
-func (socket *ReconnectingRegisteredCallbacksWebsocket) init_subsocket(subsocket *RegisteredCallbacksWebsocket) {
-	socket.ready.Store(false)
+// Resolves the URL and headers of the given dial attempt (starting at 0), calling the providers if any
+func (socket *ReconnectingRegisteredCallbacksWebsocket) resolveDialTarget(attempt int) (URL string, httpHeader http.Header, err error) {
+	URL = socket.url
+	httpHeader = socket.httpHeader
+
+	if socket.endpoints != nil {
+		URL = socket.endpoints.pick(attempt)
+	}
+
+	if socket.dialOptions.URLProvider != nil {
+		URL, err = socket.dialOptions.URLProvider(socket.ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("URL provider failed: %w", err)
+		}
+	}
+
+	if socket.dialOptions.HeaderProvider != nil {
+		providedHeader, err := socket.dialOptions.HeaderProvider(socket.ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("header provider failed: %w", err)
+		}
+
+		httpHeader = httpHeader.Clone()
+		if httpHeader == nil {
+			httpHeader = http.Header{}
+		}
+		for key, values := range providedHeader {
+			httpHeader[key] = values
+		}
+	}
+
+	return URL, httpHeader, nil
+}
+
+func (socket *ReconnectingRegisteredCallbacksWebsocket) current() *RegisteredCallbacksWebsocket {
+	return socket.base.Load()
+}
+
+func (socket *ReconnectingRegisteredCallbacksWebsocket) onStateChange(old State, new State) {
+	Logger.DEBUG(fmt.Sprintf("[%s] State changed from %s to %s", socket.GetActiveEndpoint(), old, new))
+
+	if socket.OnStateChange != nil {
+		socket.OnStateChange(old, new)
+	}
+}
+
+func (socket *ReconnectingRegisteredCallbacksWebsocket) init_subsocket(subsocket *RegisteredCallbacksWebsocket, endpoint string) {
+	subsocket.OnMessage = socket.onMessage
+	subsocket.OnMessageStream = socket.onMessageStream
+	subsocket.OnError = socket.onError
+	subsocket.OnClose = func(info CloseInfo) {
+		socket.onSubsocketClosed(subsocket, endpoint, info)
+	}
+
+	socket.base.Store(subsocket)
+	socket.activeEndpoint.Store(endpoint)
+
+	// Closed right before the subsocket was swapped in
+	if !socket.state.set(State_Open) && socket.state.isClosed() {
+		subsocket.Close()
+		return
+	}
+
+	if !socket.dialOptions.ManualStart || socket.started.Load() {
+		subsocket.Start()
+	}
+}
 
-	socket.base = subsocket
+// Starts reading from the first connection, for sockets created with 'ManualStart', no-op otherwise
+//
+// The next connections start on their own
+func (socket *ReconnectingRegisteredCallbacksWebsocket) Start() {
+	socket.started.Store(true)
+	socket.current().Start()
+}
 
-	socket.base.OnMessage = socket.onMessage
-	socket.base.OnError = socket.onError
-	socket.base.OnClose = socket.onSubsocketClosed
+// Subsockets only start reading once 'init_subsocket()' has set their callbacks
+func (socket *ReconnectingRegisteredCallbacksWebsocket) subsocketDialOptions() DialOptions {
+	dialOptions := socket.dialOptions
+	dialOptions.ManualStart = true
 
-	socket.ready.Store(true)
+	return dialOptions
 }
 
-func (socket *ReconnectingRegisteredCallbacksWebsocket) onSubsocketClosed(code int, reason string) {
-	// The reconnecting socket has been terminally closed, so no need to reconnect or do anything
-	if socket.closed.Load() {
+func (socket *ReconnectingRegisteredCallbacksWebsocket) onSubsocketClosed(subsocket *RegisteredCallbacksWebsocket, endpoint string, info CloseInfo) {
+	if socket.endpoints != nil {
+		socket.endpoints.reportLatency(endpoint, subsocket.GetStats().Latency)
+	}
+
+	// A subsocket that has been replaced (e.g. when switching back to the primary endpoint)
+	if subsocket != socket.current() {
+		return
+	}
+
+	// The reconnecting socket has been manually closed, so no need to reconnect
+	if socket.state.isClosed() {
+		socket.markAsClosed(info)
 		return
 	}
 
 	go func() {
-		socket.ready.Store(false)
+		socket.state.set(State_Reconnecting)
 		if socket.OnDisconnect != nil {
-			socket.OnDisconnect(code, reason)
+			socket.OnDisconnect(info)
 		}
 
 		err := socket.newSubsocket(true)
@@ -65,28 +183,42 @@ func (socket *ReconnectingRegisteredCallbacksWebsocket) onSubsocketClosed(code i
 		}
 
 		if socket.OnReconnect != nil {
-			socket.OnReconnect()
+			socket.OnReconnect(socket.GetActiveEndpoint())
 		}
 	}()
 }
 
 func (socket *ReconnectingRegisteredCallbacksWebsocket) newSubsocket(retry bool) error {
-	socket.ready.Store(false)
-
 	var newSocket *RegisteredCallbacksWebsocket
+	var URL string
 	var err error
 	var retries int = 0
 	for {
-		if socket.closed.Load() {
-			return fmt.Errorf("socket manually closed")
+		if socket.state.isClosed() {
+			return ErrSocketClosed
 		}
 
 		Logger.DEBUG(fmt.Sprintf("[%s] Connecting to new subsocket", socket.url))
-		newSocket, err = CreateRegisteredCallbacksWebsocket(socket.url, socket.privateMessagePropertyName, socket.isServer, socket.httpHeader)
+
+		var httpHeader http.Header
+		URL, httpHeader, err = socket.resolveDialTarget(retries)
+		if err == nil {
+			dialStart := time.Now()
+			newSocket, err = CreateRegisteredCallbacksWebsocket(URL, socket.privateMessagePropertyName, socket.isServer, httpHeader, socket.subsocketDialOptions())
+
+			if socket.endpoints != nil {
+				if err == nil {
+					socket.endpoints.reportSuccess(URL, time.Since(dialStart))
+				} else {
+					socket.endpoints.reportFailure(URL)
+				}
+			}
+		}
 		if err != nil {
-			Logger.ERROR(fmt.Sprintf("[%s] Failed to open subsocket", socket.url), err)
+			Logger.ERROR(fmt.Sprintf("[%s] Failed to open subsocket", URL), err)
 
-			if !retry {
+			// The first connection still gets to try every endpoint once
+			if !retry && (socket.endpoints == nil || retries+1 >= len(socket.endpoints.endpoints)) {
 				return err
 			} else {
 				if socket.OnReconnectError != nil {
@@ -103,17 +235,82 @@ func (socket *ReconnectingRegisteredCallbacksWebsocket) newSubsocket(retry bool)
 		break
 	}
 
-	socket.init_subsocket(newSocket)
+	// Closed while the dial was in progress
+	if socket.state.isClosed() {
+		newSocket.Close()
+		return ErrSocketClosed
+	}
+
+	socket.init_subsocket(newSocket, URL)
 
 	return nil
 }
 
+// Used by 'EndpointStrategy_Priority', switches back to the primary endpoint as soon as it is reachable again
+func (socket *ReconnectingRegisteredCallbacksWebsocket) recheckPrimaryEndpoint() {
+	interval := socket.dialOptions.PrimaryRecheckInterval
+	if interval == 0 {
+		interval = PRIMARY_RECHECK_INTERVAL_SEC * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	primary := socket.endpoints.primary()
+	for {
+		select {
+		case <-socket.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if socket.State() != State_Open || socket.GetActiveEndpoint() == primary {
+			continue
+		}
+
+		URL, httpHeader, err := socket.resolveDialTarget(0)
+		if err != nil {
+			continue
+		}
+
+		newSocket, err := CreateRegisteredCallbacksWebsocket(URL, socket.privateMessagePropertyName, socket.isServer, httpHeader, socket.subsocketDialOptions())
+		if err != nil {
+			Logger.DEBUG(fmt.Sprintf("[%s] Primary endpoint still unreachable", URL))
+			continue
+		}
+
+		// The socket may have been closed or reconnected meanwhile
+		if socket.State() != State_Open {
+			newSocket.Close()
+			continue
+		}
+
+		Logger.INFO(fmt.Sprintf("[%s] Switching back to the primary endpoint", URL))
+
+		oldSocket := socket.current()
+		socket.init_subsocket(newSocket, URL)
+		oldSocket.Close()
+
+		if socket.OnReconnect != nil {
+			socket.OnReconnect(URL)
+		}
+	}
+}
+
 func (socket *ReconnectingRegisteredCallbacksWebsocket) onMessage(messageType int, msg []byte) {
 	if socket.OnMessage != nil {
 		socket.OnMessage(messageType, msg)
 	}
 }
 
+func (socket *ReconnectingRegisteredCallbacksWebsocket) onMessageStream(messageType int, reader io.Reader) bool {
+	if socket.OnMessageStream == nil {
+		return false
+	}
+
+	return socket.OnMessageStream(messageType, reader)
+}
+
 func (socket *ReconnectingRegisteredCallbacksWebsocket) onError(err error) {
 	if socket.OnError != nil {
 		socket.OnError(err)
@@ -130,69 +327,182 @@ func (socket *ReconnectingRegisteredCallbacksWebsocket) SetHTTPHeader(httpHeader
 	socket.httpHeader = httpHeader
 }
 
+func (socket *ReconnectingRegisteredCallbacksWebsocket) State() State {
+	return socket.state.get()
+}
+
+// Blocks until the socket reaches 'state'
+//
+// Returns ErrSocketClosed if the state can no longer be reached, or ctx.Err() if the context is done first
+func (socket *ReconnectingRegisteredCallbacksWebsocket) WaitUntil(ctx context.Context, state State) error {
+	return socket.state.waitUntil(ctx, state)
+}
+
+// Returns the URL the socket is currently connected (or last connected) to
+func (socket *ReconnectingRegisteredCallbacksWebsocket) GetActiveEndpoint() string {
+	return socket.activeEndpoint.Load().(string)
+}
+
 //
 
 func (socket *ReconnectingRegisteredCallbacksWebsocket) GetParserRegistry() *parser.MessageParsers_Registry {
-	return socket.base.GetParserRegistry()
+	return socket.current().GetParserRegistry()
+}
+
+// Returns the subprotocol negotiated by the current subsocket
+func (socket *ReconnectingRegisteredCallbacksWebsocket) GetSubprotocol() string {
+	return socket.current().GetSubprotocol()
 }
 
 //
 
 func (socket *ReconnectingRegisteredCallbacksWebsocket) SendText(text string) error {
-	return socket.base.SendText(text)
+	return socket.current().SendText(text)
 }
 
 func (socket *ReconnectingRegisteredCallbacksWebsocket) SendJSON(v interface{}) error {
-	return socket.base.SendJSON(v)
+	return socket.current().SendJSON(v)
 }
 
+// Waits for the socket to be open before sending
 func (socket *ReconnectingRegisteredCallbacksWebsocket) SendPrivateMessage(message map[string]interface{}, timeout_sec ...int) (response []byte, hasTimedOut bool, err error) {
+	err = socket.WaitUntil(context.Background(), State_Open)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return socket.current().SendPrivateMessage(message, timeout_sec...)
+}
+
+// Same as 'SendPrivateMessage()', except that if the connection drops before the response arrives, the request is transparently resent once reconnected
+//
+// NOTE: The timeout covers the whole exchange, including the time spent reconnecting
+//
+// WARNING: Only use this for idempotent requests, the server may have processed the request before the connection dropped
+func (socket *ReconnectingRegisteredCallbacksWebsocket) SendIdempotentPrivateMessage(message map[string]interface{}, timeout_sec ...int) (response []byte, hasTimedOut bool, err error) {
+	timeout := 4
+	if len(timeout_sec) > 0 {
+		timeout = timeout_sec[0]
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
 	for {
-		if socket.closed.Load() {
-			return nil, false, fmt.Errorf("socket has been closed")
+		err = socket.WaitUntil(ctx, State_Open)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, true, fmt.Errorf("the request has timed out after %d seconds", timeout)
 		}
-		if !socket.ready.Load() {
-			time.Sleep(500 * time.Millisecond)
-			continue
+		if err != nil {
+			return nil, false, err
 		}
-		break
+
+		// 0 waits indefinitely
+		var remaining time.Duration
+		if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				return nil, true, fmt.Errorf("the request has timed out after %d seconds", timeout)
+			}
+		}
+
+		response, hasTimedOut, err = socket.current().base.sendPrivateMessage(message, remaining)
+		if !errors.Is(err, ErrDisconnected) {
+			return response, hasTimedOut, err
+		}
+
+		Logger.INFO(fmt.Sprintf("[%s] Disconnected before the response was received, resending once reconnected", socket.GetActiveEndpoint()))
 	}
-	return socket.base.SendPrivateMessage(message, timeout_sec...)
+}
+
+func (socket *ReconnectingRegisteredCallbacksWebsocket) SendBinary(data []byte) error {
+	return socket.current().SendBinary(data)
 }
 
 func (socket *ReconnectingRegisteredCallbacksWebsocket) SendPreparedMessage(preparedMessage *ws.PreparedMessage) error {
-	return socket.base.SendPreparedMessage(preparedMessage)
+	return socket.current().SendPreparedMessage(preparedMessage)
 }
 
+// Returns a writer streaming a single message on the current connection, every other send blocks until it is closed
+func (socket *ReconnectingRegisteredCallbacksWebsocket) NewWriter(messageType int) (io.WriteCloser, error) {
+	return socket.current().NewWriter(messageType)
+}
+
+// Same as 'CloseWithCode()' with 1000 (Normal Closure)
 func (socket *ReconnectingRegisteredCallbacksWebsocket) Close() {
-	socket.closed.Store(true)
+	socket.CloseWithCode(ws.CloseNormalClosure, "Normal Closure")
+}
 
-	socket.base.Close()
+// Stops reconnecting and closes the current connection with the given code and reason
+//
+// The state stays Closing until the close handshake completes (or times out), OnClose is then called
+func (socket *ReconnectingRegisteredCallbacksWebsocket) CloseWithCode(code int, reason string) error {
+	if !socket.state.set(State_Closing) {
+		return ErrSocketClosed
+	}
+	socket.cancel()
+
+	err := socket.current().CloseWithCode(code, reason)
+	if errors.Is(err, ErrSocketClosed) {
+		// Closed while reconnecting, there is no connection left to close
+		socket.markAsClosed(CloseInfo{Code: code, Reason: reason, Local: true, Clean: false})
+		return nil
+	}
+
+	return err
+}
+
+func (socket *ReconnectingRegisteredCallbacksWebsocket) markAsClosed(info CloseInfo) {
+	if !socket.state.set(State_Closed) {
+		return
+	}
+
+	if socket.OnClose != nil {
+		socket.OnClose(info)
+	}
 }
 
 ////
 
 // WARNING: Since this is a reconnecting socket, it will NEVER error out when trying to connect to the server, it will block until a successful connection is established
-func CreateReconnectingRegisteredCallbacksWebsocket(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header) (*ReconnectingRegisteredCallbacksWebsocket, error) {
+func CreateReconnectingRegisteredCallbacksWebsocket(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header, opt_dialOptions ...DialOptions) (*ReconnectingRegisteredCallbacksWebsocket, error) {
 	var socket ReconnectingRegisteredCallbacksWebsocket
 
-	socket.init(URL, privateMessagePropertyName, isServer, httpHeader)
+	var dialOptions DialOptions
+	if len(opt_dialOptions) != 0 {
+		dialOptions = opt_dialOptions[0]
+	}
+
+	socket.init(URL, privateMessagePropertyName, isServer, httpHeader, dialOptions)
 
 	err := socket.newSubsocket(false)
 	if err != nil {
 		return nil, err
 	}
 
+	if socket.endpoints != nil && len(socket.endpoints.endpoints) > 1 && dialOptions.EndpointStrategy == EndpointStrategy_Priority && dialOptions.PrimaryRecheckInterval >= 0 {
+		go socket.recheckPrimaryEndpoint()
+	}
+
 	return &socket, nil
 }
 
-func AssignReconnectingRegisteredCallbacksWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header) *ReconnectingRegisteredCallbacksWebsocket {
+func AssignReconnectingRegisteredCallbacksWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header, opt_dialOptions ...DialOptions) *ReconnectingRegisteredCallbacksWebsocket {
 	var socket ReconnectingRegisteredCallbacksWebsocket
 
-	socket.init(URL, privateMessagePropertyName, isServer, httpHeader)
+	var dialOptions DialOptions
+	if len(opt_dialOptions) != 0 {
+		dialOptions = opt_dialOptions[0]
+	}
+
+	socket.init(URL, privateMessagePropertyName, isServer, httpHeader, dialOptions)
 
-	baseSocket := AssignRegisteredCallbacksWebsocket(conn, URL, privateMessagePropertyName, isServer)
-	socket.init_subsocket(baseSocket)
+	baseSocket := AssignRegisteredCallbacksWebsocket(conn, URL, privateMessagePropertyName, isServer, socket.subsocketDialOptions().SocketOptions)
+	socket.init_subsocket(baseSocket, URL)
 
 	return &socket
 }
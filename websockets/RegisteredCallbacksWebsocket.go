@@ -1,6 +1,8 @@
 package websockets
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 
 	"github.com/GTedZ/gows/parser"
@@ -12,9 +14,22 @@ type RegisteredCallbacksWebsocket struct {
 
 	parserRegistry *parser.MessageParsers_Registry
 
+	// Called for every inbound message before it reaches the parsers and 'OnMessage'
+	//
+	// The message is only processed further if 'dispatch' is called, allowing it to be dropped, delayed, wrapped or rewritten: the given bytes are the ones processed
+	InterceptMessage func(messageType int, msg []byte, dispatch func(msg []byte))
+	// Same as 'InterceptMessage' for streamed messages, 'dispatch' hands the given reader to 'OnMessageStream'
+	//
+	// Returns false if the message wasn't consumed, in which case it is buffered and goes through 'InterceptMessage'
+	InterceptMessageStream func(messageType int, reader io.Reader, dispatch func(reader io.Reader) (handled bool)) (handled bool)
+
 	OnMessage func(messageType int, msg []byte)
-	OnError   func(err error)
-	OnClose   func(code int, reason string)
+	// Called instead of OnMessage for messages bigger than the stream threshold, returns false if the message wasn't consumed
+	//
+	// Streamed messages skip the parsers
+	OnMessageStream func(messageType int, reader io.Reader) (handled bool)
+	OnError         func(err error)
+	OnClose         func(info CloseInfo)
 }
 
 func (socket *RegisteredCallbacksWebsocket) init(baseSocket *privateMessageWebsocket) {
@@ -22,12 +37,26 @@ func (socket *RegisteredCallbacksWebsocket) init(baseSocket *privateMessageWebso
 	socket.parserRegistry = &parser.MessageParsers_Registry{}
 
 	socket.base.OnMessage = socket.onMessage
+	socket.base.OnMessageStream = socket.onMessageStream
 	socket.base.OnError = socket.onError
 	socket.base.OnClose = socket.onClose
 }
 
 func (socket *RegisteredCallbacksWebsocket) onMessage(messageType int, msg []byte) {
-	if socket.parserRegistry.TryDispatch(msg) {
+	if socket.InterceptMessage != nil {
+		socket.InterceptMessage(messageType, msg, func(msg []byte) { socket.dispatch(messageType, msg) })
+		return
+	}
+
+	socket.dispatch(messageType, msg)
+}
+
+func (socket *RegisteredCallbacksWebsocket) dispatch(messageType int, msg []byte) {
+	if messageType == ws.BinaryMessage {
+		if !socket.isReserved(msg) && socket.parserRegistry.TryDispatchBinary(msg) {
+			return
+		}
+	} else if socket.parserRegistry.TryDispatch(msg) {
 		return
 	}
 
@@ -36,15 +65,40 @@ func (socket *RegisteredCallbacksWebsocket) onMessage(messageType int, msg []byt
 	}
 }
 
+// Whether 'msg' starts with one of 'SocketOptions.ReservedPrefixes'
+func (socket *RegisteredCallbacksWebsocket) isReserved(msg []byte) bool {
+	for _, prefix := range socket.base.base.options.ReservedPrefixes {
+		if bytes.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (socket *RegisteredCallbacksWebsocket) onMessageStream(messageType int, reader io.Reader) bool {
+	if socket.OnMessageStream == nil {
+		return false
+	}
+
+	if socket.InterceptMessageStream != nil {
+		return socket.InterceptMessageStream(messageType, reader, func(reader io.Reader) bool {
+			return socket.OnMessageStream(messageType, reader)
+		})
+	}
+
+	return socket.OnMessageStream(messageType, reader)
+}
+
 func (socket *RegisteredCallbacksWebsocket) onError(err error) {
 	if socket.OnError != nil {
 		socket.OnError(err)
 	}
 }
 
-func (socket *RegisteredCallbacksWebsocket) onClose(code int, reason string) {
+func (socket *RegisteredCallbacksWebsocket) onClose(info CloseInfo) {
 	if socket.OnClose != nil {
-		socket.OnClose(code, reason)
+		socket.OnClose(info)
 	}
 }
 
@@ -56,6 +110,19 @@ func (socket *RegisteredCallbacksWebsocket) GetParserRegistry() *parser.MessageP
 	return socket.parserRegistry
 }
 
+func (socket *RegisteredCallbacksWebsocket) GetStats() Stats {
+	return socket.base.GetStats()
+}
+
+// Starts reading from the connection, for sockets created with 'SocketOptions.ManualStart', no-op otherwise
+func (socket *RegisteredCallbacksWebsocket) Start() {
+	socket.base.start()
+}
+
+func (socket *RegisteredCallbacksWebsocket) GetSubprotocol() string {
+	return socket.base.GetSubprotocol()
+}
+
 //
 
 func (socket *RegisteredCallbacksWebsocket) SendText(text string) error {
@@ -70,20 +137,38 @@ func (socket *RegisteredCallbacksWebsocket) SendPrivateMessage(message map[strin
 	return socket.base.SendPrivateMessage(message, timeout_sec...)
 }
 
+func (socket *RegisteredCallbacksWebsocket) SendBinary(data []byte) error {
+	return socket.base.SendBinary(data)
+}
+
 func (socket *RegisteredCallbacksWebsocket) SendPreparedMessage(preparedMessage *ws.PreparedMessage) error {
 	return socket.base.SendPreparedMessage(preparedMessage)
 }
 
+// Returns a writer streaming a single message, every other send blocks until it is closed
+func (socket *RegisteredCallbacksWebsocket) NewWriter(messageType int) (io.WriteCloser, error) {
+	return socket.base.NewWriter(messageType)
+}
+
 func (socket *RegisteredCallbacksWebsocket) Close() {
 	socket.base.Close()
 }
 
+func (socket *RegisteredCallbacksWebsocket) CloseWithCode(code int, reason string) error {
+	return socket.base.CloseWithCode(code, reason)
+}
+
 ////
 
-func CreateRegisteredCallbacksWebsocket(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header) (*RegisteredCallbacksWebsocket, error) {
+func CreateRegisteredCallbacksWebsocket(URL string, privateMessagePropertyName string, isServer bool, httpHeader http.Header, opt_dialOptions ...DialOptions) (*RegisteredCallbacksWebsocket, error) {
 	var socket RegisteredCallbacksWebsocket
 
-	baseSocket, err := createPrivateMessageWebsocket(URL, privateMessagePropertyName, httpHeader, isServer)
+	var dialOptions DialOptions
+	if len(opt_dialOptions) != 0 {
+		dialOptions = opt_dialOptions[0]
+	}
+
+	baseSocket, err := createPrivateMessageWebsocket(URL, privateMessagePropertyName, httpHeader, isServer, dialOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -93,10 +178,15 @@ func CreateRegisteredCallbacksWebsocket(URL string, privateMessagePropertyName s
 	return &socket, nil
 }
 
-func AssignRegisteredCallbacksWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool) *RegisteredCallbacksWebsocket {
+func AssignRegisteredCallbacksWebsocket(conn *ws.Conn, URL string, privateMessagePropertyName string, isServer bool, opt_options ...SocketOptions) *RegisteredCallbacksWebsocket {
 	var socket RegisteredCallbacksWebsocket
 
-	baseSocket := assignPrivateMessageWebsocket(conn, URL, privateMessagePropertyName, isServer)
+	var options SocketOptions
+	if len(opt_options) != 0 {
+		options = opt_options[0]
+	}
+
+	baseSocket := assignPrivateMessageWebsocket(conn, URL, privateMessagePropertyName, isServer, options)
 
 	socket.init(baseSocket)
 
@@ -0,0 +1,119 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned when waiting on, or sending through, a socket that has been manually closed
+var ErrSocketClosed = errors.New("socket has been closed")
+
+type State int
+
+const (
+	// Establishing the first connection
+	State_Connecting State = iota
+	State_Open
+	// The connection dropped and a new one is being established
+	State_Reconnecting
+	// Manually closed, waiting for the close handshake to complete
+	State_Closing
+	// Manually closed, this state is terminal
+	State_Closed
+)
+
+func (state State) String() string {
+	switch state {
+	case State_Connecting:
+		return "Connecting"
+	case State_Open:
+		return "Open"
+	case State_Reconnecting:
+		return "Reconnecting"
+	case State_Closing:
+		return "Closing"
+	case State_Closed:
+		return "Closed"
+	}
+
+	return "Unknown"
+}
+
+// Holds the current state and wakes up everyone waiting on a change
+type stateMachine struct {
+	mu    sync.Mutex
+	state State
+	// Closed (and replaced) on every state change
+	changed chan struct{}
+
+	OnStateChange func(old State, new State)
+}
+
+func (machine *stateMachine) init(initial State) {
+	machine.state = initial
+	machine.changed = make(chan struct{})
+}
+
+func (machine *stateMachine) get() State {
+	machine.mu.Lock()
+	defer machine.mu.Unlock()
+
+	return machine.state
+}
+
+// Transitions to 'new', returns false if already in that state or if the socket has been manually closed
+//
+// Once Closing, the only allowed transition is to Closed
+func (machine *stateMachine) set(new State) bool {
+	machine.mu.Lock()
+
+	old := machine.state
+	if old == new || old == State_Closed || (old == State_Closing && new != State_Closed) {
+		machine.mu.Unlock()
+		return false
+	}
+
+	machine.state = new
+	close(machine.changed)
+	machine.changed = make(chan struct{})
+
+	machine.mu.Unlock()
+
+	if machine.OnStateChange != nil {
+		machine.OnStateChange(old, new)
+	}
+
+	return true
+}
+
+// Whether the socket has been manually closed (Closing or Closed)
+func (machine *stateMachine) isClosed() bool {
+	state := machine.get()
+	return state == State_Closing || state == State_Closed
+}
+
+// Blocks until the state becomes 'target'
+//
+// Returns ErrSocketClosed if the state can no longer be reached, or ctx.Err() if the context is done first
+func (machine *stateMachine) waitUntil(ctx context.Context, target State) error {
+	for {
+		machine.mu.Lock()
+		state := machine.state
+		changed := machine.changed
+		machine.mu.Unlock()
+
+		if state == target {
+			return nil
+		}
+		if state == State_Closed || (state == State_Closing && target != State_Closed) {
+			return ErrSocketClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
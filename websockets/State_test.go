@@ -0,0 +1,243 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+type stateChange struct {
+	old State
+	new State
+}
+
+// Records every state change the machine emits
+func newRecordedStateMachine(initial State) (*stateMachine, func() []stateChange) {
+	var mu sync.Mutex
+	var changes []stateChange
+
+	machine := &stateMachine{}
+	machine.init(initial)
+	machine.OnStateChange = func(old State, new State) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		changes = append(changes, stateChange{old, new})
+	}
+
+	return machine, func() []stateChange {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return slices.Clone(changes)
+	}
+}
+
+// Waits in the background, the returned channel gets 'waitUntil()'s result
+func waitInBackground(ctx context.Context, machine *stateMachine, target State) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- machine.waitUntil(ctx, target)
+	}()
+
+	return result
+}
+
+func expectWaitResult(t *testing.T, result <-chan error, expected error) {
+	t.Helper()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, expected) {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting")
+	}
+}
+
+func expectStillWaiting(t *testing.T, result <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-result:
+		t.Fatalf("expected to still be waiting, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+//// Transitions
+
+func TestStateMachineTransitions(t *testing.T) {
+	machine, changes := newRecordedStateMachine(State_Connecting)
+
+	steps := []struct {
+		state   State
+		allowed bool
+	}{
+		{State_Connecting, false},
+		{State_Open, true},
+		{State_Open, false},
+		{State_Reconnecting, true},
+		{State_Open, true},
+		{State_Closing, true},
+		// Once Closing, only Closed is allowed
+		{State_Open, false},
+		{State_Reconnecting, false},
+		{State_Closed, true},
+		// Closed is terminal
+		{State_Open, false},
+		{State_Closing, false},
+		{State_Closed, false},
+	}
+
+	for _, step := range steps {
+		if allowed := machine.set(step.state); allowed != step.allowed {
+			t.Fatalf("expected the transition from %s to %s to be allowed: %v, got %v", machine.get(), step.state, step.allowed, allowed)
+		}
+	}
+
+	// Once per transition that went through
+	expected := []stateChange{
+		{State_Connecting, State_Open},
+		{State_Open, State_Reconnecting},
+		{State_Reconnecting, State_Open},
+		{State_Open, State_Closing},
+		{State_Closing, State_Closed},
+	}
+	if got := changes(); !slices.Equal(got, expected) {
+		t.Fatalf("expected the state changes %v, got %v", expected, got)
+	}
+}
+
+//// Waiting
+
+func TestStateMachineWaitUntil(t *testing.T) {
+	t.Run("returns on the target state", func(t *testing.T) {
+		machine, _ := newRecordedStateMachine(State_Connecting)
+
+		result := waitInBackground(context.Background(), machine, State_Open)
+		expectStillWaiting(t, result)
+
+		// Woken up by the other changes, keeps waiting
+		machine.set(State_Reconnecting)
+		expectStillWaiting(t, result)
+
+		machine.set(State_Open)
+		expectWaitResult(t, result, nil)
+
+		// Already there
+		expectWaitResult(t, waitInBackground(context.Background(), machine, State_Open), nil)
+	})
+
+	t.Run("returns once the context is done", func(t *testing.T) {
+		machine, _ := newRecordedStateMachine(State_Connecting)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := waitInBackground(ctx, machine, State_Open)
+		expectStillWaiting(t, result)
+
+		cancel()
+		expectWaitResult(t, result, context.Canceled)
+	})
+
+	t.Run("returns once the target can no longer be reached", func(t *testing.T) {
+		machine, _ := newRecordedStateMachine(State_Open)
+
+		reconnecting := waitInBackground(context.Background(), machine, State_Reconnecting)
+		closed := waitInBackground(context.Background(), machine, State_Closed)
+
+		machine.set(State_Closing)
+		expectWaitResult(t, reconnecting, ErrSocketClosed)
+		expectStillWaiting(t, closed)
+
+		machine.set(State_Closed)
+		expectWaitResult(t, closed, nil)
+
+		expectWaitResult(t, waitInBackground(context.Background(), machine, State_Open), ErrSocketClosed)
+	})
+}
+
+//// Reconnecting socket
+
+func TestReconnectingSocketStates(t *testing.T) {
+	// Every connection is answered until it is dropped, the server's read loop answers the close handshake
+	conns := make(chan *ws.Conn, 16)
+	upgrader := ws.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	// Not reading until the callback is set
+	options := DialOptions{SocketOptions: SocketOptions{ManualStart: true}}
+	socket, err := CreateReconnectingRegisteredCallbacksWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), "id", false, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := socket.State(); state != State_Open {
+		t.Fatalf("expected the socket to be open once created, got %s", state)
+	}
+
+	changes := make(chan stateChange, 16)
+	socket.OnStateChange = func(old State, new State) { changes <- stateChange{old, new} }
+	socket.Start()
+
+	expectChanges := func(expected ...stateChange) {
+		t.Helper()
+
+		for _, change := range expected {
+			select {
+			case got := <-changes:
+				if got != change {
+					t.Fatalf("expected the state to change from %s to %s, got %s to %s", change.old, change.new, got.old, got.new)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for the state to change from %s to %s", change.old, change.new)
+			}
+		}
+	}
+
+	// Dropped by the server
+	first := <-conns
+	first.UnderlyingConn().Close()
+	expectChanges(stateChange{State_Open, State_Reconnecting}, stateChange{State_Reconnecting, State_Open})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := socket.WaitUntil(ctx, State_Open); err != nil {
+		t.Fatal(err)
+	}
+
+	socket.Close()
+	expectChanges(stateChange{State_Open, State_Closing}, stateChange{State_Closing, State_Closed})
+
+	if err := socket.WaitUntil(ctx, State_Open); !errors.Is(err, ErrSocketClosed) {
+		t.Fatalf("expected %v once closed, got %v", ErrSocketClosed, err)
+	}
+
+	select {
+	case change := <-changes:
+		t.Fatalf("expected no change once closed, got %s to %s", change.old, change.new)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -3,7 +3,9 @@ package websockets
 import (
 	"crypto/rand"
 	"fmt"
+	"net/url"
 
+	ws "github.com/gorilla/websocket"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -16,6 +18,36 @@ func generateRandomString() string {
 	return fmt.Sprintf("%x", b)
 }
 
+// Returns 'URL' with the given query parameters set, existing parameters of the same name are overwritten
+func applyQuery(URL string, query url.Values) (string, error) {
+	if len(query) == 0 {
+		return URL, nil
+	}
+
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for key, values := range query {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Same as 'CheckMessageIsPrivate()', binary messages are never private
+func CheckMessageTypeIsPrivate(messageType int, msg []byte, privateMessagePropertyName string) (requestId string, isPrivate bool) {
+	if messageType == ws.BinaryMessage {
+		return "", false
+	}
+
+	return CheckMessageIsPrivate(msg, privateMessagePropertyName)
+}
+
+// Private messages are JSON objects carrying a string 'privateMessagePropertyName'
 func CheckMessageIsPrivate(msg []byte, privateMessagePropertyName string) (requestId string, isPrivate bool) {
 	if len(msg) == 0 {
 		return "", false